@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/binchenx/guestfs"
+)
+
+// A/B root partitions for atomic updates
+//
+// Root is populated in slot A, slot B is left empty until the first update.
+// grub.cfg and grubenv live on the shared efi partition and grub boots the
+// first slot in ORDER which is OK and has tries left, each boot consuming one
+// try. Once booted, d2b-boot-ok.service resets the tries of the slot. An update
+// writes the new root in the other slot and put it first in ORDER, if it fails
+// to boot MaxTries times grub falls back to the previous slot.
+type ABScheme struct {
+	// SlotA and SlotB are the names of the root partitions
+	SlotA string `yaml:"slotA"`
+	SlotB string `yaml:"slotB"`
+	// MaxTries is the number of boot attempts of a slot before falling back
+	MaxTries int `yaml:"maxTries,omitempty"`
+}
+
+const (
+	abSlotA         = "A"
+	abSlotB         = "B"
+	abDefaultTries  = 3
+	abBootOkScript  = "/usr/lib/d2b/boot-ok"
+	abBootOkService = "/etc/systemd/system/d2b-boot-ok.service"
+)
+
+func (ab *ABScheme) maxTries() int {
+	if ab.MaxTries == 0 {
+		return abDefaultTries
+	}
+	return ab.MaxTries
+}
+
+// partition return the name of the root partition of slot
+func (ab *ABScheme) partition(slot string) string {
+	if slot == abSlotB {
+		return ab.SlotB
+	}
+	return ab.SlotA
+}
+
+// NewABLayout is the default layout with two root slots and a shared data
+// partition, the efi partition is mounted at /boot/efi so that each slot has
+// its own kernel in /boot
+func NewABLayout() *DiskLayout {
+	return &DiskLayout{
+		ParitionType: "gpt",
+		Partitions: []Partition{
+			{
+				ID:      1,
+				Start:   2048,
+				End:     4095,
+				Name:    PartitionNameBiosboot,
+				GptType: GptTypeBiosBoot,
+			},
+			{
+				ID:         2,
+				Start:      8192,
+				End:        212991,
+				Name:       PartitionNameEFI,
+				GptType:    GptTypeEFI,
+				Fstype:     "vfat",
+				FsLabel:    "ESP",
+				MountPoint: "/boot/efi",
+			},
+			{
+				ID:         3,
+				Start:      212992,
+				End:        1851391,
+				Name:       "root_a",
+				Fstype:     "ext4",
+				FsLabel:    "ROOT_A",
+				MountPoint: "/",
+				FsMountOps: "defaults,noatime,rw",
+			},
+			{
+				ID:         4,
+				Start:      1851392,
+				End:        3489791,
+				Name:       "root_b",
+				Fstype:     "ext4",
+				FsLabel:    "ROOT_B",
+				FsMountOps: "defaults,noatime,rw",
+			},
+			{
+				ID:         5,
+				Start:      3489792,
+				End:        4161535,
+				Name:       "data",
+				Fstype:     "ext4",
+				FsLabel:    "DATA",
+				MountPoint: "/data",
+				FsMountOps: "defaults,noatime,rw",
+			},
+		},
+		AB: &ABScheme{
+			SlotA: "root_a",
+			SlotB: "root_b",
+		},
+	}
+}
+
+func (d *DiskLayout) validateAB() error {
+	ab := d.AB
+	if ab == nil {
+		return nil
+	}
+
+	if d.Verity != nil {
+		return fmt.Errorf("ab: can not be used with verity")
+	}
+	if ab.MaxTries < 0 {
+		return fmt.Errorf("ab: maxTries should be positive")
+	}
+
+	for _, name := range []string{ab.SlotA, ab.SlotB} {
+		var found bool
+		for _, p := range d.Partitions {
+			if p.Name != name {
+				continue
+			}
+			found = true
+			if p.Fstype == "" || p.FsLabel == "" || p.Encrypted != "" || len(p.Subvolumes) != 0 {
+				return fmt.Errorf("ab: slot %s should have a plain labeled filesystem", name)
+			}
+		}
+		if !found {
+			return fmt.Errorf("ab: slot partition %s not found", name)
+		}
+	}
+
+	if d.abSlotMountPoint(ab.SlotB) != "" {
+		return fmt.Errorf("ab: slot %s should not be mounted", ab.SlotB)
+	}
+	if d.abSlotMountPoint(ab.SlotA) != "/" {
+		return fmt.Errorf("ab: slot %s should be mounted at /", ab.SlotA)
+	}
+
+	if d.espMountPoint() == "/boot" {
+		return fmt.Errorf("ab: efi partition should not be mounted at /boot, each slot has its own /boot")
+	}
+
+	return nil
+}
+
+func (d *DiskLayout) abSlotMountPoint(name string) string {
+	for _, p := range d.Partitions {
+		if p.Name == name {
+			return p.MountPoint
+		}
+	}
+	return ""
+}
+
+// espMountPoint return where the efi partition is mounted
+func (d *DiskLayout) espMountPoint() string {
+	for _, p := range d.Partitions {
+		if p.Name == PartitionNameEFI {
+			return p.MountPoint
+		}
+	}
+	return ""
+}
+
+// forSlot return a copy of the layout with slot mounted as root
+func (d *DiskLayout) forSlot(slot string) *DiskLayout {
+	layout := *d
+	layout.Partitions = append([]Partition{}, d.Partitions...)
+	for i := range layout.Partitions {
+		p := &layout.Partitions[i]
+		switch p.Name {
+		case d.AB.partition(slot):
+			p.MountPoint = "/"
+		case d.AB.SlotA, d.AB.SlotB:
+			p.MountPoint = ""
+		}
+	}
+	return &layout
+}
+
+// slotLabel return the filesystem label of the partition of slot
+func (d *DiskLayout) slotLabel(slot string) string {
+	for _, p := range d.Partitions {
+		if p.Name == d.AB.partition(slot) {
+			return p.FsLabel
+		}
+	}
+	return ""
+}
+
+var abGrubCfgTemplate = `# generated by docker2boot, A/B slot selection
+serial --speed=115200 --unit=0 --word=8 --parity=no --stop=1
+terminal_input serial console
+terminal_output serial console
+set timeout=3
+
+set ORDER="A B"
+set A_OK=0
+set B_OK=0
+set A_LEFT=0
+set B_LEFT=0
+load_env
+
+# boot the first slot of ORDER that is OK with tries left, and consume one try
+set slot=
+for s in $ORDER; do
+{{- range $slot := .Slots }}
+	if [ "$s" = "{{ $slot }}" -a "${{ $slot }}_OK" = "1" ]; then
+	{{- range $.Tries }}
+		{{ if eq . $.MaxTries }}if{{ else }}elif{{ end }} [ "${{ $slot }}_LEFT" = "{{ . }}" ]; then
+			set {{ $slot }}_LEFT={{ dec . }}
+			set slot={{ $slot }}
+	{{- end }}
+		fi
+	fi
+{{- end }}
+	if [ -n "$slot" ]; then
+		break
+	fi
+done
+
+# no slot left, try the preferred one anyway
+if [ -z "$slot" ]; then
+	for s in $ORDER; do
+		set slot=$s
+		break
+	done
+fi
+save_env A_LEFT B_LEFT
+
+{{- range $i, $slot := .Slots }}
+
+if [ "$slot" = "{{ $slot }}" ]; then
+	set default={{ $i }}
+fi
+menuentry "slot {{ $slot }}" {
+	search --no-floppy --set=root --label {{ index $.Labels $slot }}
+	if [ -e /vmlinuz ]; then
+		linux /vmlinuz root=LABEL={{ index $.Labels $slot }} ro d2b.slot={{ $slot }} {{ $.Cmdline }}
+		initrd /initrd.img
+	else
+		linux /boot/vmlinuz root=LABEL={{ index $.Labels $slot }} ro d2b.slot={{ $slot }} {{ $.Cmdline }}
+		initrd /boot/initrd.img
+	fi
+}
+{{- end }}
+`
+
+// abGrubCfg generate the grub.cfg selecting the slot from grubenv
+func (d *DiskLayout) abGrubCfg(cmdline string) (string, error) {
+	var tries []int
+	for i := d.AB.maxTries(); i > 0; i-- {
+		tries = append(tries, i)
+	}
+
+	funcs := template.FuncMap{"dec": func(i int) int { return i - 1 }}
+	tmpl, err := template.New("grub.cfg").Funcs(funcs).Parse(abGrubCfgTemplate)
+	if err != nil {
+		return "", err
+	}
+
+	w := bytes.NewBufferString("")
+	err = tmpl.Execute(w, map[string]interface{}{
+		"Slots":    []string{abSlotA, abSlotB},
+		"Labels":   map[string]string{abSlotA: d.slotLabel(abSlotA), abSlotB: d.slotLabel(abSlotB)},
+		"Tries":    tries,
+		"MaxTries": d.AB.maxTries(),
+		"Cmdline":  cmdline,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return w.String(), nil
+}
+
+// grubenv is a 1024 bytes block of name=value lines padded with #
+const grubenvSize = 1024
+const grubenvHeader = "# GRUB Environment Block\n"
+
+func parseGrubenv(data string) map[string]string {
+	env := map[string]string{}
+	for _, line := range strings.Split(data, "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) == 2 {
+			env[kv[0]] = kv[1]
+		}
+	}
+	return env
+}
+
+func formatGrubenv(env map[string]string, keys []string) ([]byte, error) {
+	var b strings.Builder
+	b.WriteString(grubenvHeader)
+	for _, k := range keys {
+		b.WriteString(k + "=" + env[k] + "\n")
+	}
+	if b.Len() > grubenvSize {
+		return nil, fmt.Errorf("grubenv is larger than %d bytes", grubenvSize)
+	}
+	return []byte(b.String() + strings.Repeat("#", grubenvSize-b.Len())), nil
+}
+
+var grubenvKeys = []string{"ORDER", "A_OK", "A_LEFT", "B_OK", "B_LEFT"}
+
+// abActivateSlot update env to boot slot first with all its tries
+func abActivateSlot(env map[string]string, slot string, maxTries int) {
+	other := abSlotB
+	if slot == abSlotB {
+		other = abSlotA
+	}
+	env["ORDER"] = slot + " " + other
+	env[slot+"_OK"] = "1"
+	env[slot+"_LEFT"] = strconv.Itoa(maxTries)
+	for _, k := range []string{other + "_OK", other + "_LEFT"} {
+		if env[k] == "" {
+			env[k] = "0"
+		}
+	}
+}
+
+// abActiveSlot return the slot grub boots, the first of ORDER which is OK
+// with tries left, like grub.cfg, e.g. A once a failed update of B fell back
+func abActiveSlot(env map[string]string) string {
+	order := strings.Fields(env["ORDER"])
+	if len(order) == 0 {
+		return abSlotA
+	}
+	for _, slot := range order {
+		left, _ := strconv.Atoi(env[slot+"_LEFT"])
+		if env[slot+"_OK"] == "1" && left > 0 {
+			return slot
+		}
+	}
+	return order[0]
+}
+
+const abBootOkScriptData = `#!/bin/sh
+# mark the booted A/B slot as good, see d2b-boot-ok.service
+slot=$(sed -n 's/.*d2b\.slot=\([AB]\).*/\1/p' /proc/cmdline)
+[ -n "$slot" ] || exit 0
+grub-editenv %s set ${slot}_OK=1 ${slot}_LEFT=%d
+`
+
+const abBootOkServiceData = `[Unit]
+Description=Mark the booted A/B slot as good
+After=multi-user.target
+
+[Service]
+Type=oneshot
+ExecStart=` + abBootOkScript + `
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// install the service resetting the tries of the booted slot
+func installABBootOk(g *guestfs.Guestfs, diskLayout *DiskLayout) {
+	grubenv := path.Join(diskLayout.espMountPoint(), "grub/grubenv")
+	files := map[string]string{
+		abBootOkScript:  fmt.Sprintf(abBootOkScriptData, grubenv, diskLayout.AB.maxTries()),
+		abBootOkService: abBootOkServiceData,
+	}
+	for file, content := range files {
+		if err := g.Mkdir_p(path.Dir(file)); err != nil {
+			log.Fatalln(err.Errmsg)
+		}
+		if err := g.Write(file, []byte(content)); err != nil {
+			log.Fatalln(err.Errmsg)
+		}
+	}
+	if err := g.Chmod(0755, abBootOkScript); err != nil {
+		log.Fatalln(err.Errmsg)
+	}
+
+	wants := "/etc/systemd/system/multi-user.target.wants"
+	if err := g.Mkdir_p(wants); err != nil {
+		log.Fatalln(err.Errmsg)
+	}
+	if err := g.Ln_sf(abBootOkService, path.Join(wants, path.Base(abBootOkService))); err != nil {
+		log.Fatalln(err.Errmsg)
+	}
+}
+
+// install grub on the shared efi partition with the A/B grub.cfg and grubenv
+func installABBootloader(g *guestfs.Guestfs, device string, diskLayout *DiskLayout, cmdline string) {
+	log.Println("[Info] Install A/B bootloader")
+	bootDir := diskLayout.espMountPoint()
+	// grub modules, grub.cfg and grubenv are on the efi partition so that they
+	// are shared by the slots
+	if out, err := g.Command([]string{"grub-install", "--target=i386-pc", "--boot-directory=" + bootDir, device}); err != nil {
+		log.Fatalf("Fail to install grub %s %s\n", out, err.Errmsg)
+	}
+	if out, err := g.Command([]string{"grub-install",
+		"--target=x86_64-efi",
+		"--efi-directory=" + bootDir,
+		"--boot-directory=" + bootDir,
+		"--bootloader-id=GRUB",
+		"--removable", device}); err != nil {
+		log.Fatalf("Fail to install grub %s %s\n", out, err.Errmsg)
+	}
+
+	cfg, err := diskLayout.abGrubCfg(strings.TrimSpace(cmdline + " " + diskLayout.kernelCmdline()))
+	if err != nil {
+		log.Fatalf("Fail to generate grub.cfg %s\n", err)
+	}
+	if err := g.Write(path.Join(bootDir, "grub/grub.cfg"), []byte(cfg)); err != nil {
+		log.Fatalln(err.Errmsg)
+	}
+
+	env := map[string]string{}
+	abActivateSlot(env, abSlotA, diskLayout.AB.maxTries())
+	writeGrubenv(g, path.Join(bootDir, "grub/grubenv"), env)
+
+	installABBootOk(g, diskLayout)
+	log.Println("[Info] Install A/B bootloader DONE")
+}
+
+func writeGrubenv(g *guestfs.Guestfs, file string, env map[string]string) {
+	data, err := formatGrubenv(env, grubenvKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := g.Write(file, data); err != nil {
+		log.Fatalln(err.Errmsg)
+	}
+	log.Printf("[Info]   grubenv ORDER=%s\n", env["ORDER"])
+}
+
+// UpdateInactiveSlot write contents to the slot of disk which is not booted
+// first and make it the one to boot, falling back to the current slot if it
+// fails to boot
+func UpdateInactiveSlot(diskImage Disk, diskLayout *DiskLayout, contents *[]Content, config *Config, debug bool) {
+	if diskLayout.AB == nil {
+		log.Fatalf("disk layout has no A/B slots\n")
+	}
+	target, terr := config.target()
+	if terr != nil {
+		log.Fatal(terr)
+	}
+
+	g, errno := guestfs.Create()
+	if errno != nil {
+		panic(errno)
+	}
+	defer g.Close()
+
+	if _, err := os.Stat(diskImage.Name); err != nil {
+		log.Fatalf("Fail to open disk %s\n", err)
+	}
+
+	if debug == true {
+		g.Set_trace(true)
+	}
+
+	optargs := guestfs.OptargsAdd_drive{
+		Format_is_set:   true,
+		Format:          "raw",
+		Readonly_is_set: true,
+		Readonly:        false,
+	}
+	if err := g.Add_drive(diskImage.Name, &optargs); err != nil {
+		panic(err)
+	}
+	// installing packages in the guest needs network
+	if customizeNeedNetwork(config.Customize) {
+		if err := g.Set_network(true); err != nil {
+			panic(err)
+		}
+	}
+
+	if err := g.Launch(); err != nil {
+		panic(err)
+	}
+
+	// find the slot to update from grubenv
+	espDevice, err := getPartitionDeviceByName(g, PartitionNameEFI)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := g.Mount(espDevice, "/"); err != nil {
+		log.Fatalln(err.Errmsg)
+	}
+	data, gerr := g.Cat("/grub/grubenv")
+	if gerr != nil {
+		log.Fatalf("Fail to read grubenv %s\n", gerr.Errmsg)
+	}
+	if err := g.Umount_all(); err != nil {
+		log.Fatalln(err.Errmsg)
+	}
+
+	env := parseGrubenv(data)
+	slot := abSlotB
+	if abActiveSlot(env) == abSlotB {
+		slot = abSlotA
+	}
+	log.Printf("[Info] Update slot %s of %s\n", slot, diskImage.Name)
+
+	// recreate the filesystem of the slot and populate it
+	slotLayout := diskLayout.forSlot(slot)
+	slotDevice, err := getPartitionDeviceByName(g, diskLayout.AB.partition(slot))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, p := range slotLayout.Partitions {
+		if p.Name == diskLayout.AB.partition(slot) {
+			if err := createFilesystem(g, slotDevice, p.Fstype, p.FsLabel, p.MkfsOptions, nil); err != nil {
+				log.Fatalf("Fail to create fs on %s: %s\n", slotDevice, err)
+			}
+		}
+	}
+
+	// only the root of the slot is mounted, the shared partitions of a disk
+	// in use are not written by the new image
+	mountAt(g, slotLayout, "/")
+	if err := copyRootfsData(g, contents, slotLayout); err != nil {
+		log.Fatalf("Fail to import rootfs data %s\n", err)
+	}
+	customizeGuest(g, config, slotLayout)
+	createAdditionalSettings(g, slotLayout)
+	installTargetSettings(g, target)
+	updateInitramfs(g, slotLayout, target.InitramfsModules)
+	generalizeGuest(g, config.Generalize)
+	installABBootOk(g, slotLayout)
+
+	// but grubenv, to boot the slot
+	mountAt(g, slotLayout, diskLayout.espMountPoint())
+	abActivateSlot(env, slot, diskLayout.AB.maxTries())
+	writeGrubenv(g, path.Join(diskLayout.espMountPoint(), "grub/grubenv"), env)
+
+	if err := g.Shutdown(); err != nil {
+		panic(fmt.Sprintf("write to disk failed: %s", err))
+	}
+}
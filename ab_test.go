@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestABLayout(t *testing.T) {
+	layout := NewABLayout()
+	if err := layout.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(layout.fstab(), "LABEL=ROOT_A / ext4") {
+		t.Errorf("slot A should be root:\n%s", layout.fstab())
+	}
+
+	slotB := layout.forSlot(abSlotB)
+	if err := slotB.validate(); err == nil {
+		t.Errorf("expected error for slot B mounted as root in the layout")
+	}
+	if !strings.Contains(slotB.fstab(), "LABEL=ROOT_B / ext4") {
+		t.Errorf("slot B should be root:\n%s", slotB.fstab())
+	}
+	if layout.Partitions[3].MountPoint != "" {
+		t.Errorf("forSlot should not change the layout")
+	}
+}
+
+func TestABGrubCfg(t *testing.T) {
+	layout := NewABLayout()
+	cfg, err := layout.abGrubCfg("console=ttyS0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"\t\tif [ \"$A_LEFT\" = \"3\" ]; then\n\t\t\tset A_LEFT=2\n\t\t\tset slot=A\n",
+		"\t\telif [ \"$B_LEFT\" = \"1\" ]; then\n\t\t\tset B_LEFT=0\n\t\t\tset slot=B\n\t\tfi\n",
+		"if [ \"$slot\" = \"B\" ]; then\n\tset default=1\nfi",
+		"linux /vmlinuz root=LABEL=ROOT_B ro d2b.slot=B console=ttyS0",
+	} {
+		if !strings.Contains(cfg, expected) {
+			t.Errorf("missing %q in grub.cfg:\n%s", expected, cfg)
+		}
+	}
+}
+
+func TestGrubenv(t *testing.T) {
+	env := map[string]string{}
+	abActivateSlot(env, abSlotA, 3)
+
+	data, err := formatGrubenv(env, grubenvKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != grubenvSize {
+		t.Errorf("grubenv should be %d bytes, got %d", grubenvSize, len(data))
+	}
+
+	env = parseGrubenv(string(data))
+	if abActiveSlot(env) != abSlotA || env["A_LEFT"] != "3" || env["B_OK"] != "0" {
+		t.Errorf("unexpected grubenv %v", env)
+	}
+
+	abActivateSlot(env, abSlotB, 3)
+	if env["ORDER"] != "B A" || env["B_OK"] != "1" || env["A_OK"] != "1" {
+		t.Errorf("unexpected grubenv %v", env)
+	}
+
+	// B failed to boot its tries, grub fell back to A
+	env = map[string]string{"ORDER": "B A", "A_OK": "1", "A_LEFT": "3", "B_OK": "1", "B_LEFT": "0"}
+	if slot := abActiveSlot(env); slot != abSlotA {
+		t.Errorf("active slot %s of a failed update, want A", slot)
+	}
+}
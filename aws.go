@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+)
+
+// ec2 import artefacts of the raw disk, see aws/README.md
+
+// S3Location is where the disk is uploaded
+type S3Location struct {
+	Endpoint string
+	Region   string
+	Bucket   string
+	Key      string
+}
+
+// placeholder replaced by the id of the imported snapshot
+const awsSnapshotIDPlaceholder = "SNAPSHOT_ID"
+
+// awsDiskContainer is the --disk-container of ec2 import-snapshot
+type awsDiskContainer struct {
+	Description string `json:"Description"`
+	Format      string `json:"Format"`
+	UserBucket  struct {
+		S3Bucket string `json:"S3Bucket"`
+		S3Key    string `json:"S3Key"`
+	} `json:"UserBucket"`
+}
+
+type awsEbs struct {
+	SnapshotId          string `json:"SnapshotId"`
+	VolumeSize          int64  `json:"VolumeSize"`
+	VolumeType          string `json:"VolumeType"`
+	DeleteOnTermination bool   `json:"DeleteOnTermination"`
+}
+
+type awsBlockDeviceMapping struct {
+	DeviceName string `json:"DeviceName"`
+	Ebs        awsEbs `json:"Ebs"`
+}
+
+// awsRegisterImage is the --cli-input-json of ec2 register-image
+type awsRegisterImage struct {
+	Name                string                  `json:"Name"`
+	Architecture        string                  `json:"Architecture"`
+	BootMode            string                  `json:"BootMode"`
+	EnaSupport          bool                    `json:"EnaSupport"`
+	SriovNetSupport     string                  `json:"SriovNetSupport,omitempty"`
+	VirtualizationType  string                  `json:"VirtualizationType"`
+	RootDeviceName      string                  `json:"RootDeviceName"`
+	BlockDeviceMappings []awsBlockDeviceMapping `json:"BlockDeviceMappings"`
+}
+
+// awsImportFormats are the output formats ec2 import-snapshot reads, by their
+// name in the disk container
+var awsImportFormats = map[string]string{
+	OutputFormatRaw:  "raw",
+	OutputFormatVhd:  "vhd",
+	OutputFormatVmdk: "vmdk",
+}
+
+func newAwsDiskContainer(location S3Location, format string) *awsDiskContainer {
+	c := &awsDiskContainer{
+		Description: "docker2boot " + location.Key,
+		Format:      awsImportFormats[format],
+	}
+	c.UserBucket.S3Bucket = location.Bucket
+	c.UserBucket.S3Key = location.Key
+	return c
+}
+
+// awsBootMode return the ec2 boot mode supported by the layout, efi is always
+// there and bios is too when it is the firmware of the layout
+func (d *DiskLayout) awsBootMode() string {
+	if d.firmware() == FirmwareBios {
+		return "uefi-preferred"
+	}
+	return "uefi"
+}
+
+func newAwsRegisterImage(name string, disk Disk, layout *DiskLayout, target *Target) *awsRegisterImage {
+	const GiB = 1024 * 1024 * 1024
+
+	var ena bool
+	for _, m := range target.InitramfsModules {
+		if m == "ena" {
+			ena = true
+		}
+	}
+
+	r := &awsRegisterImage{
+		Name:               name,
+		Architecture:       "x86_64",
+		BootMode:           layout.awsBootMode(),
+		EnaSupport:         ena,
+		VirtualizationType: "hvm",
+		RootDeviceName:     "/dev/xvda",
+		BlockDeviceMappings: []awsBlockDeviceMapping{
+			{
+				DeviceName: "/dev/xvda",
+				Ebs: awsEbs{
+					SnapshotId:          awsSnapshotIDPlaceholder,
+					VolumeSize:          (disk.Size + GiB - 1) / GiB,
+					VolumeType:          "gp3",
+					DeleteOnTermination: true,
+				},
+			},
+		},
+	}
+	if ena {
+		r.SriovNetSupport = "simple"
+	}
+	return r
+}
+
+// writeAwsImportFiles write containers.json and register-image.json next to
+// the disk
+func writeAwsImportFiles(disk Disk, layout *DiskLayout, target *Target, location S3Location, format string) error {
+	dir := filepath.Dir(disk.Name)
+	name := filepath.Base(disk.Name)
+	files := map[string]interface{}{
+		"containers.json":     newAwsDiskContainer(location, format),
+		"register-image.json": newAwsRegisterImage(name, disk, layout, target),
+	}
+	for file, v := range files {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		file = filepath.Join(dir, file)
+		if err := ioutil.WriteFile(file, append(data, '\n'), 0644); err != nil {
+			return err
+		}
+		log.Printf("[Info] Write %s\n", file)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// boot a disk with qemu on the console, the disk is opened with -snapshot so
+// the changes are discarded when qemu exits
+
+const defaultOvmf = "/usr/share/ovmf/OVMF.fd"
+
+type bootOptions struct {
+	cpus     int
+	memory   int
+	firmware string
+	ovmf     string
+	kvm      bool
+	// seed is a cloud-init seed image attached as a second drive
+	seed string
+}
+
+// qemuBootArgs return the qemu-system-x86_64 arguments booting disk
+func qemuBootArgs(disk string, o bootOptions) ([]string, error) {
+	// ova, vagrant boxes and gce images are archives of a disk
+	switch filepath.Ext(disk) {
+	case ".ova", ".box", ".gz":
+		return nil, fmt.Errorf("%s is an archive, boot the disk it contains", disk)
+	}
+	format := diskImageFormat(disk)
+	args := []string{
+		"-nographic",
+		"-serial", "mon:stdio",
+		"-snapshot",
+		"-smp", strconv.Itoa(o.cpus),
+		"-m", strconv.Itoa(o.memory),
+		"-netdev", "user,id=net0",
+		"-device", "virtio-net-pci,netdev=net0",
+		"-drive", fmt.Sprintf("file=%s,if=virtio,format=%s", disk, format),
+	}
+	if o.seed != "" {
+		args = append(args, "-drive", fmt.Sprintf("file=%s,if=virtio,format=raw", o.seed))
+	}
+	switch o.firmware {
+	case FirmwareBios:
+	case FirmwareEfi:
+		args = append(args, "-bios", o.ovmf)
+	default:
+		return nil, fmt.Errorf("unknown firmware %s, should be bios or efi", o.firmware)
+	}
+	if o.kvm {
+		args = append(args, "-enable-kvm", "-cpu", "host")
+	}
+	return args, nil
+}
+
+func runBoot(cmd *command, args []string) error {
+	var o bootOptions
+	fs := cmd.flagSet()
+	fs.IntVar(&o.cpus, "cpus", 2, "number of CPUs")
+	fs.IntVar(&o.memory, "memory", 2048, "memory in MB")
+	fs.StringVar(&o.firmware, "firmware", FirmwareBios, "bios or efi")
+	fs.StringVar(&o.ovmf, "ovmf", defaultOvmf, "the efi firmware used with -firmware efi")
+	fs.StringVar(&o.seed, "seed", "", "cloud-init seed image, e.g. created by cloud-localds, attached as a second drive")
+	if err := cmd.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return usageError("should specify one disk")
+	}
+	disk := fs.Arg(0)
+	if _, err := os.Stat(disk); err != nil {
+		return usageError("%s", err)
+	}
+	if _, err := os.Stat("/dev/kvm"); err == nil {
+		o.kvm = true
+	}
+
+	qemuArgs, err := qemuBootArgs(disk, o)
+	if err != nil {
+		return usageError("%s", err)
+	}
+	qemu := exec.Command("qemu-system-x86_64", qemuArgs...)
+	qemu.Stdin = os.Stdin
+	qemu.Stdout = os.Stdout
+	qemu.Stderr = os.Stderr
+	if err := qemu.Run(); err != nil {
+		return fmt.Errorf("qemu-system-x86_64 %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/binchenx/guestfs"
+)
+
+// cloud-init NoCloud seed embedded in the disk, see
+// https://cloudinit.readthedocs.io/en/latest/topics/datasources/nocloud.html
+
+const (
+	CloudInitSeedNoCloud   = "nocloud"
+	CloudInitSeedPartition = "partition"
+)
+
+const (
+	cloudInitSeedDir        = "/var/lib/cloud/seed/nocloud"
+	cloudInitDatasourceFile = "/etc/cloud/cloud.cfg.d/90_d2b_datasource.cfg"
+	// the label cloud-init looks for, the partition is found by name
+	cloudInitPartitionName  = "cidata"
+	cloudInitPartitionLabel = "CIDATA"
+	// 8MB
+	cloudInitPartitionSectors = 16384
+)
+
+// nocloud needs a meta-data even if empty, the instance-id tells cloud-init
+// it is a new instance
+const cloudInitDefaultMetaData = "instance-id: iid-d2b\n"
+
+var cloudInitDefaultDatasources = []string{"NoCloud", "None"}
+
+func (c *CloudInit) seed() string {
+	if c.Seed == "" {
+		return CloudInitSeedNoCloud
+	}
+	return c.Seed
+}
+
+func (c *CloudInit) hasSeed() bool {
+	return c.UserData != "" || c.MetaData != "" || c.NetworkConfig != "" || c.VendorData != ""
+}
+
+func (c *CloudInit) validate() error {
+	if c.seed() != CloudInitSeedNoCloud && c.seed() != CloudInitSeedPartition {
+		return fmt.Errorf("cloud-init: unsupported seed %s", c.Seed)
+	}
+	if c.UserData != "" && !strings.HasPrefix(c.UserData, "#") {
+		return fmt.Errorf("cloud-init: user-data should start with #cloud-config, #! or another # header")
+	}
+	return nil
+}
+
+// seedFiles return the files of the seed, meta-data is always present
+func (c *CloudInit) seedFiles() map[string]string {
+	files := map[string]string{
+		"meta-data": c.MetaData,
+	}
+	if c.MetaData == "" {
+		files["meta-data"] = cloudInitDefaultMetaData
+	}
+	if c.UserData != "" {
+		files["user-data"] = c.UserData
+	}
+	if c.NetworkConfig != "" {
+		files["network-config"] = c.NetworkConfig
+	}
+	if c.VendorData != "" {
+		files["vendor-data"] = c.VendorData
+	}
+	return files
+}
+
+// datasourceConfig return the cloud.cfg.d setting of the datasources
+func (c *CloudInit) datasourceConfig() string {
+	datasources := c.Datasources
+	if len(datasources) == 0 {
+		datasources = cloudInitDefaultDatasources
+	}
+	return fmt.Sprintf("datasource_list: [ %s ]\n", strings.Join(datasources, ", "))
+}
+
+// addCloudInitPartition append the CIDATA partition after the last partition
+// of a disk of diskSize bytes
+func (d *DiskLayout) addCloudInitPartition(diskSize int64) error {
+	var id int
+	var end int64
+	for _, p := range d.Partitions {
+		if p.Name == cloudInitPartitionName {
+			return nil
+		}
+		if p.ID > id {
+			id = p.ID
+		}
+		if p.End > end {
+			end = p.End
+		}
+	}
+
+	// aligned to 1MB, the backup gpt uses the last 33 sectors
+	start := (end/2048 + 1) * 2048
+	last := start + cloudInitPartitionSectors - 1
+	if last >= diskSize/512-34 {
+		return fmt.Errorf("cloud-init: no space left for the %s partition after sector %d", cloudInitPartitionName, end)
+	}
+
+	d.Partitions = append(d.Partitions, Partition{
+		ID:      id + 1,
+		Start:   start,
+		End:     last,
+		Name:    cloudInitPartitionName,
+		Fstype:  FstypeVfat,
+		FsLabel: cloudInitPartitionLabel,
+	})
+	return nil
+}
+
+// write the seed and the datasources
+func installCloudInit(g *guestfs.Guestfs, c *CloudInit, diskLayout *DiskLayout) {
+	if c == nil {
+		return
+	}
+	if err := c.validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("[Info] Setup cloud-init")
+	if err := g.Mkdir_p(path.Dir(cloudInitDatasourceFile)); err != nil {
+		log.Fatalln(err.Errmsg)
+	}
+	if err := g.Write(cloudInitDatasourceFile, []byte(c.datasourceConfig())); err != nil {
+		log.Fatalln(err.Errmsg)
+	}
+
+	if !c.hasSeed() {
+		return
+	}
+
+	dir := cloudInitSeedDir
+	if c.seed() == CloudInitSeedPartition {
+		mountPoint, umount, err := mountContentPartition(g, cloudInitPartitionName, diskLayout)
+		if err != nil {
+			log.Fatalf("Fail to mount the cloud-init partition %s\n", err)
+		}
+		defer umount()
+		dir = mountPoint
+	}
+
+	if err := g.Mkdir_p(dir); err != nil {
+		log.Fatalln(err.Errmsg)
+	}
+	for name, content := range c.seedFiles() {
+		log.Printf("[Info]   %s\n", path.Join(dir, name))
+		if err := g.Write(path.Join(dir, name), []byte(content)); err != nil {
+			log.Fatalln(err.Errmsg)
+		}
+	}
+}
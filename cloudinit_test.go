@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCloudInitSeed(t *testing.T) {
+	c := CloudInit{UserData: "#cloud-config\nhostname: devicu\n"}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	files := c.seedFiles()
+	if len(files) != 2 || files["meta-data"] != cloudInitDefaultMetaData {
+		t.Errorf("unexpected seed files %#v", files)
+	}
+	if ds := c.datasourceConfig(); ds != "datasource_list: [ NoCloud, None ]\n" {
+		t.Errorf("unexpected datasources %s", ds)
+	}
+
+	invalid := []CloudInit{
+		{Seed: "iso"},
+		{UserData: "hostname: devicu\n"},
+	}
+	for _, c := range invalid {
+		if err := c.validate(); err == nil {
+			t.Errorf("expected error for %#v", c)
+		}
+	}
+}
+
+func TestAddCloudInitPartition(t *testing.T) {
+	const GB = 1024 * 1024 * 1024
+	layout := NewDefaultLayout()
+	if err := layout.addCloudInitPartition(2 * GB); err != nil {
+		t.Fatal(err)
+	}
+	p := layout.Partitions[len(layout.Partitions)-1]
+	if p.ID != 5 || p.Start != 4161536 || p.End != 4177919 || p.FsLabel != cloudInitPartitionLabel {
+		t.Errorf("unexpected partition %#v", p)
+	}
+	if err := layout.validate(); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+
+	// added once
+	if err := layout.addCloudInitPartition(2 * GB); err != nil || len(layout.Partitions) != 5 {
+		t.Errorf("partition added twice")
+	}
+
+	if err := NewDefaultLayout().addCloudInitPartition(4161536 * 512); err == nil {
+		t.Errorf("expected error for a full disk")
+	}
+}
@@ -1,18 +1,72 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
 
 type Config struct {
+	// Include are configs merged before this one, relative to its directory,
+	// see loadConfig
+	Include []string `yaml:"include,omitempty"`
+	// Override replaces the values of the included configs instead of being
+	// merged with them
+	Override *Config `yaml:"override,omitempty"`
+	// Environments are overlays merged on top of the config by name, e.g. dev,
+	// stage or prod
+	Environments map[string]*Config `yaml:"environments,omitempty"`
+
+	// From is the docker image the config is applied on, e.g. a company base
+	// image, instead of ubuntu:UbuntuVersion. Kernel is then optional.
+	From          string   `yaml:"from,omitempty"`
 	Kernel        string   `yaml:"kernel,omitempty"`
 	UbuntuVersion string   `yaml:"ubuntuVersion,omitempty"`
 	Login         string   `yaml:"login,omitempty"`
 	Packages      []string `yaml:"packages,omitempty"`
 	Systemd       Systemd  `yaml:"systemd,omitempty"`
 	Files         []File   `yaml:"files,omitempty"`
+	// DockerfileTemplate is a text/template replacing the built-in Dockerfile
+	// template, it is executed with the config
+	DockerfileTemplate string `yaml:"dockerfileTemplate,omitempty"`
+	// Contents are copied to the disk in addition to the image
+	Contents []ContentSource `yaml:"contents,omitempty"`
+	// Add are host files and directories copied after the contents
+	Add []Addition `yaml:"add,omitempty"`
+	// Customize are run in the guest after the contents are copied and before
+	// the bootloader is installed
+	Customize []Customization `yaml:"customize,omitempty"`
+	// Firstboot are scripts run once at the first boot
+	Firstboot []FirstbootScript `yaml:"firstboot,omitempty"`
+	// CloudInit embeds a cloud-init seed in the disk
+	CloudInit *CloudInit `yaml:"cloudInit,omitempty"`
+	// Generalize reset what is specific to the built image, all the operations
+	// are run if not set
+	Generalize *Generalize `yaml:"generalize,omitempty"`
+	// Target is the platform the disk boots on, see targets
+	Target string `yaml:"target,omitempty"`
+	// VM is the virtual machine described by the ova output
+	VM *VM `yaml:"vm,omitempty"`
+
+	// source is the file of the config and lines the file and line of each key
+	// path, e.g. files[0].mode, see fileLines
+	source string
+	lines  map[string]configLine
+	// keys are the keys set in the files, the config decoded without its
+	// structure, while the config is loaded
+	keys interface{}
+}
+
+// configLine is where a key is set
+type configLine struct {
+	file string
+	line int
 }
 
 type Systemd struct {
@@ -24,23 +78,580 @@ type SystemdUnit struct {
 	Enabled bool   `yaml:"enabled,omitempty"`
 }
 
+// File is created in the image, see files.go
 type File struct {
-	Path    string `yaml:"path,omitempty"`
-	Mode    string `yaml:"mode,omitempty"`
-	Content string `yaml:"content,omitempty"`
+	Path string `yaml:"path,omitempty"`
+	// Type is file (default), dir or symlink
+	Type string `yaml:"type,omitempty"`
+	Mode string `yaml:"mode,omitempty"`
+	// Owner and Group are names in the image or numbers, root if not set
+	Owner string `yaml:"owner,omitempty"`
+	Group string `yaml:"group,omitempty"`
+	// Content of the file, decoded according to Encoding, or Source a host
+	// file copied as is
+	Content  string `yaml:"content,omitempty" expand:"false"`
+	Encoding string `yaml:"encoding,omitempty"`
+	Source   string `yaml:"source,omitempty"`
+	// Template executes the content as a text/template with the config
+	Template bool `yaml:"template,omitempty"`
+	// Append the content to the file of the image instead of replacing it
+	Append bool `yaml:"append,omitempty"`
+	// Target of a symlink
+	Target string `yaml:"target,omitempty"`
+}
+
+type ContentSource struct {
+	// Source is the path of the tarball or directory, or the docker image
+	Source string `yaml:"source"`
+	// Type is one of tar, dir and image
+	Type string `yaml:"type"`
+	// DestDir is where to copy the content, default to /
+	DestDir string `yaml:"destDir,omitempty"`
+	// Partition is the name of the partition to copy to, DestDir is then
+	// relative to the root of the partition
+	Partition string `yaml:"partition,omitempty"`
+}
+
+// Addition copy a host file or directory to the guest without going through
+// the docker build, e.g. for secrets and large artefacts
+type Addition struct {
+	// Source is the host file or directory
+	Source string `yaml:"source"`
+	// Dest is the path of the file or directory in the guest, a directory is
+	// merged with an existing one
+	Dest string `yaml:"dest"`
+	// Owner and Group override the owner recursively, a name in the image or a
+	// number. The host owner is kept if not set.
+	Owner string `yaml:"owner,omitempty"`
+	Group string `yaml:"group,omitempty"`
+	// Mode override the mode of Dest, e.g. 0600. The host mode is kept if not set.
+	Mode string `yaml:"mode,omitempty"`
+}
+
+// Customization is one action run in the guest, only one field can be set
+type Customization struct {
+	// Run is a shell command
+	Run string `yaml:"run,omitempty" expand:"false"`
+	// Script is a host script copied to the guest and run
+	Script string `yaml:"script,omitempty"`
+	// Install are packages installed with apt-get
+	Install []string `yaml:"install,omitempty"`
+	// Edit a file with a sed expression
+	Edit *FileEdit `yaml:"edit,omitempty"`
+	// Link create a symbolic link
+	Link *Symlink `yaml:"link,omitempty"`
+}
+
+type FileEdit struct {
+	Path string `yaml:"path"`
+	// Expression is a sed expression, e.g. s/^#Port 22/Port 2222/
+	Expression string `yaml:"expression"`
+}
+
+type Symlink struct {
+	Path   string `yaml:"path"`
+	Target string `yaml:"target"`
 }
 
+// FirstbootScript is run once by a generated systemd oneshot unit
+type FirstbootScript struct {
+	// Name of the script and of the unit d2b-firstboot-<name>.service
+	Name string `yaml:"name"`
+	// Script is a host script, or Content the script itself
+	Script  string `yaml:"script,omitempty"`
+	Content string `yaml:"content,omitempty" expand:"false"`
+	// After and Before are the units to order the script with, e.g.
+	// network-online.target or cloud-final.service
+	After  []string `yaml:"after,omitempty"`
+	Before []string `yaml:"before,omitempty"`
+}
+
+// CloudInit is a NoCloud seed and the datasources cloud-init looks for
+type CloudInit struct {
+	// Seed is where the seed is stored, CloudInitSeedNoCloud (default) for
+	// /var/lib/cloud/seed/nocloud or CloudInitSeedPartition for a CIDATA
+	// partition added at the end of the disk
+	Seed          string `yaml:"seed,omitempty"`
+	UserData      string `yaml:"userData,omitempty" expand:"false"`
+	MetaData      string `yaml:"metaData,omitempty" expand:"false"`
+	NetworkConfig string `yaml:"networkConfig,omitempty" expand:"false"`
+	VendorData    string `yaml:"vendorData,omitempty" expand:"false"`
+	// Datasources is the datasource_list, default [NoCloud, None]
+	Datasources []string `yaml:"datasources,omitempty"`
+}
+
+// Generalize select the operations reseting the image: machine-id,
+// ssh-hostkeys, apt, logs, histories, tmp and cloud-init
+type Generalize struct {
+	// Disabled skip all the operations
+	Disabled bool `yaml:"disabled,omitempty"`
+	// Operations are the operations to run, all if empty
+	Operations []string `yaml:"operations,omitempty"`
+	// Skip are the operations not run
+	Skip []string `yaml:"skip,omitempty"`
+}
+
+// VM is the hardware of the virtual machine running the disk
+type VM struct {
+	// CPUs default to 2
+	CPUs int `yaml:"cpus,omitempty"`
+	// Memory in MB, default to 2048
+	Memory int `yaml:"memory,omitempty"`
+	// NICs is the number of network interfaces, default to 1
+	NICs int `yaml:"nics,omitempty"`
+}
+
+// getConfigFromFile load the config without environment nor values set
 func getConfigFromFile(file string) (*Config, error) {
+	return loadConfig(file, "", nil)
+}
+
+// loadConfig load the config of file, merged with its includes, the overlay
+// of environment env and the values of sets, key=value with key a dotted path
+// like vm.memory.
+//
+// The configs are merged in order: the includes, the file, its override, the
+// environment and the sets. A config included twice is merged once. Lists are
+// appended, structs and maps are merged and the values set replaced, false and
+// 0 included, except by override and sets which replace the lists too.
+// ${VAR} and ${VAR:-default} are replaced by the environment variables in the
+// values of the config files, but in the scripts and contents run or written
+// in the guest, see expandVars.
+func loadConfig(file string, env string, sets []string) (*Config, error) {
+	config, err := readConfigFile(file, nil, map[string]bool{})
+	if err != nil {
+		return nil, err
+	}
+
+	for name := range config.Environments {
+		if strings.Contains(name, ".") {
+			return nil, fmt.Errorf("%s: invalid environment %s, a name can't contain a dot", file, name)
+		}
+	}
+	if env != "" {
+		overlay, ok := config.Environments[env]
+		if !ok {
+			return nil, fmt.Errorf("%s: no environment %s", file, env)
+		}
+		if len(overlay.Include) != 0 {
+			return nil, fmt.Errorf("%s: environment %s can't include configs", file, env)
+		}
+		config.mergeWithOverride(config.sub(overlay, "environments", env))
+	}
+	config.Environments = nil
+
+	for _, set := range sets {
+		kv := strings.SplitN(set, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid --set %s, should be key=value", set)
+		}
+		value, err := configFromPath(kv[0], kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid --set %s: %s", set, err)
+		}
+		config.merge(value, true)
+	}
+	config.keys = nil
+	return config, nil
+}
+
+// readConfigFile read file and merge its includes, parents are the files
+// including it and merged the files already merged, nil is returned for a
+// file merged already
+func readConfigFile(file string, parents []string, merged map[string]bool) (*Config, error) {
+	file = filepath.Clean(file)
+	for _, p := range parents {
+		if p == file {
+			return nil, fmt.Errorf("%s: include cycle %s", file, strings.Join(append(parents, file), " -> "))
+		}
+	}
+	if merged[file] {
+		return nil, nil
+	}
+	merged[file] = true
 	data, err := ioutil.ReadFile(file)
 	if err != nil {
 		return nil, err
 	}
 
 	var config Config
-	err = yaml.Unmarshal([]byte(data), &config)
+	err = yaml.UnmarshalStrict([]byte(data), &config)
 	if err != nil {
+		return nil, yamlErrors(file, err)
+	}
+	if err := yaml.Unmarshal(data, &config.keys); err != nil {
+		return nil, yamlErrors(file, err)
+	}
+	config.source = file
+	config.lines = fileLines(file, data, config.keys)
+	if err := config.expandVars(); err != nil {
 		return nil, err
 	}
+	config.resolvePaths(filepath.Dir(file))
+
+	result := &Config{source: file, lines: map[string]configLine{}}
+	for _, include := range config.Include {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(file), include)
+		}
+		c, err := readConfigFile(include, append(parents, file), merged)
+		if err != nil {
+			return nil, err
+		}
+		if c != nil {
+			result.merge(c, false)
+		}
+	}
+	result.mergeWithOverride(&config)
+	result.Include = nil
+	return result, nil
+}
+
+// resolvePaths make the relative host paths of the config relative to dir,
+// the directory of its file, instead of the working directory
+func (c *Config) resolvePaths(dir string) {
+	resolve := func(p *string) {
+		if *p != "" && !filepath.IsAbs(*p) {
+			*p = filepath.Join(dir, *p)
+		}
+	}
+	resolve(&c.DockerfileTemplate)
+	for i := range c.Files {
+		resolve(&c.Files[i].Source)
+	}
+	for i := range c.Contents {
+		if c.Contents[i].Type != ContentTypeImage {
+			resolve(&c.Contents[i].Source)
+		}
+	}
+	for i := range c.Add {
+		resolve(&c.Add[i].Source)
+	}
+	for i := range c.Customize {
+		resolve(&c.Customize[i].Script)
+	}
+	for i := range c.Firstboot {
+		resolve(&c.Firstboot[i].Script)
+	}
+	if c.Override != nil {
+		c.Override.resolvePaths(dir)
+	}
+	for _, env := range c.Environments {
+		env.resolvePaths(dir)
+	}
+}
+
+// fileLines return the file and line of each key path of the yaml data with
+// the keys, the keys without a line, e.g. in a flow style list, have the line
+// of their parent
+func fileLines(file string, data []byte, keys interface{}) map[string]configLine {
+	numbers := yamlLines(data)
+	lines := map[string]configLine{}
+	var fill func(v interface{}, p string, line int)
+	fill = func(v interface{}, p string, line int) {
+		if n, ok := numbers[p]; ok {
+			line = n
+		}
+		if p != "" {
+			lines[p] = configLine{file, line}
+		}
+		switch v := v.(type) {
+		case map[interface{}]interface{}:
+			for k, child := range v {
+				fill(child, joinKey(p, fmt.Sprint(k)), line)
+			}
+		case []interface{}:
+			for i, child := range v {
+				fill(child, fmt.Sprintf("%s[%d]", p, i), line)
+			}
+		}
+	}
+	fill(keys, "", 0)
+	return lines
+}
+
+// sub return the config under the keys of c, e.g. its override, with
+// its keys and lines
+func (c *Config) sub(sub *Config, keys ...string) *Config {
+	s := *sub
+	s.source = c.source
+	s.keys = c.keys
+	p := ""
+	for _, key := range keys {
+		m, _ := s.keys.(map[interface{}]interface{})
+		s.keys = m[key]
+		p = joinKey(p, key)
+	}
+	s.lines = map[string]configLine{}
+	for k, l := range c.lines {
+		if rest, ok := trimKey(k, p); ok {
+			s.lines[strings.TrimPrefix(rest, ".")] = l
+		}
+	}
+	return &s
+}
+
+// trimKey return the rest of the key path k under p, ok if k is p or under p
+func trimKey(k string, p string) (string, bool) {
+	if p == "" {
+		return k, true
+	}
+	if !strings.HasPrefix(k, p) {
+		return "", false
+	}
+	rest := k[len(p):]
+	return rest, rest == "" || rest[0] == '.' || rest[0] == '['
+}
 
+// mergeWithOverride merge src to c, then the override of src replacing the
+// values and the lists
+func (c *Config) mergeWithOverride(src *Config) {
+	override := src.Override
+	src.Override = nil
+	c.merge(src, false)
+	if override != nil {
+		c.merge(src.sub(override, "override"), true)
+	}
+	c.Override = nil
+}
+
+// merge the keys of src set in its file to c, replace replaces the lists
+// instead of appending them
+func (c *Config) merge(src *Config, replace bool) {
+	if c.lines == nil {
+		c.lines = map[string]configLine{}
+	}
+	m := configMerge{dstLines: c.lines, srcLines: src.lines, replace: replace}
+	m.value(reflect.ValueOf(c).Elem(), reflect.ValueOf(src).Elem(), src.keys, "", "")
+	c.keys = mergeKeys(c.keys, src.keys, replace)
+}
+
+// configMerge merge a config to another, the lines of the keys merged are
+// moved from srcLines to dstLines
+type configMerge struct {
+	dstLines map[string]configLine
+	srcLines map[string]configLine
+	replace  bool
+}
+
+// value merge src to dst, keys are the keys of src set in its file, the
+// values not set are not merged
+func (m *configMerge) value(dst, src reflect.Value, keys interface{}, dstPath, srcPath string) {
+	switch dst.Kind() {
+	case reflect.Struct:
+		set, _ := keys.(map[interface{}]interface{})
+		t := dst.Type()
+		for i := 0; i < dst.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			key := yamlKey(f)
+			if k, ok := set[key]; ok {
+				m.value(dst.Field(i), src.Field(i), k, joinKey(dstPath, key), joinKey(srcPath, key))
+			}
+		}
+	case reflect.Ptr:
+		if src.IsNil() {
+			return
+		}
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		m.copyLine(dstPath, srcPath)
+		m.value(dst.Elem(), src.Elem(), keys, dstPath, srcPath)
+	case reflect.Slice:
+		if m.replace || dst.Len() == 0 {
+			m.deleteLines(dstPath)
+			m.copyLines(dstPath, srcPath)
+			dst.Set(reflect.AppendSlice(reflect.MakeSlice(dst.Type(), 0, src.Len()), src))
+			return
+		}
+		n := dst.Len()
+		for i := 0; i < src.Len(); i++ {
+			m.copyLines(fmt.Sprintf("%s[%d]", dstPath, n+i), fmt.Sprintf("%s[%d]", srcPath, i))
+		}
+		// a new slice so that the included config is not modified
+		merged := reflect.MakeSlice(dst.Type(), 0, dst.Len()+src.Len())
+		merged = reflect.AppendSlice(merged, dst)
+		dst.Set(reflect.AppendSlice(merged, src))
+	case reflect.Map:
+		set, _ := keys.(map[interface{}]interface{})
+		if dst.IsNil() {
+			dst.Set(reflect.MakeMap(dst.Type()))
+		}
+		m.copyLine(dstPath, srcPath)
+		for _, k := range src.MapKeys() {
+			dk, sk := joinKey(dstPath, k.String()), joinKey(srcPath, k.String())
+			d := dst.MapIndex(k)
+			if d.IsValid() && d.Kind() == reflect.Ptr && !d.IsNil() {
+				m.value(d, src.MapIndex(k), set[k.String()], dk, sk)
+				continue
+			}
+			m.deleteLines(dk)
+			m.copyLines(dk, sk)
+			dst.SetMapIndex(k, src.MapIndex(k))
+		}
+	default:
+		// the value is set, even false or 0
+		m.deleteLines(dstPath)
+		m.copyLines(dstPath, srcPath)
+		dst.Set(src)
+	}
+}
+
+// copyLine copy the line of srcPath, not of the keys under it
+func (m *configMerge) copyLine(dstPath, srcPath string) {
+	if l, ok := m.srcLines[srcPath]; ok && dstPath != "" {
+		m.dstLines[dstPath] = l
+	}
+}
+
+// copyLines copy the lines of srcPath and the keys under it
+func (m *configMerge) copyLines(dstPath, srcPath string) {
+	for k, l := range m.srcLines {
+		if rest, ok := trimKey(k, srcPath); ok {
+			m.dstLines[dstPath+rest] = l
+		}
+	}
+}
+
+func (m *configMerge) deleteLines(p string) {
+	for k := range m.dstLines {
+		if _, ok := trimKey(k, p); ok {
+			delete(m.dstLines, k)
+		}
+	}
+}
+
+// mergeKeys return the keys set by dst and src, src replaces the lists of
+// dst if replace
+func mergeKeys(dst, src interface{}, replace bool) interface{} {
+	switch s := src.(type) {
+	case map[interface{}]interface{}:
+		d, ok := dst.(map[interface{}]interface{})
+		if !ok {
+			return s
+		}
+		merged := map[interface{}]interface{}{}
+		for k, v := range d {
+			merged[k] = v
+		}
+		for k, v := range s {
+			merged[k] = mergeKeys(d[k], v, replace)
+		}
+		return merged
+	case []interface{}:
+		d, ok := dst.([]interface{})
+		if !ok || replace {
+			return s
+		}
+		return append(append([]interface{}{}, d...), s...)
+	}
+	return src
+}
+
+// configFromPath return the config with only the value at path set, e.g.
+// vm.memory and 4096, the value is yaml
+func configFromPath(path string, value string) (*Config, error) {
+	keys := strings.Split(path, ".")
+	var b strings.Builder
+	for i, key := range keys {
+		if key == "" {
+			return nil, fmt.Errorf("empty key")
+		}
+		b.WriteString(strings.Repeat("  ", i) + key + ":")
+		if i < len(keys)-1 {
+			b.WriteString("\n")
+		}
+	}
+	b.WriteString(" " + value + "\n")
+
+	var config Config
+	if err := yaml.UnmarshalStrict([]byte(b.String()), &config); err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal([]byte(b.String()), &config.keys); err != nil {
+		return nil, err
+	}
 	return &config, nil
 }
+
+var configVarRe = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandVars replace ${VAR} and ${VAR:-default} by the environment variables
+// in the string values of the config, $${ is a literal ${. The fields tagged
+// expand:"false" are kept as is, they are scripts and contents where ${ is
+// for the guest.
+func (c *Config) expandVars() error {
+	errs := c.errors()
+	expandValue(reflect.ValueOf(c).Elem(), "", errs)
+	return errs.err()
+}
+
+func expandValue(v reflect.Value, p string, errs *configErrors) {
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" || f.Tag.Get("expand") == "false" {
+				continue
+			}
+			expandValue(v.Field(i), joinKey(p, yamlKey(f)), errs)
+		}
+	case reflect.Ptr:
+		if !v.IsNil() {
+			expandValue(v.Elem(), p, errs)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			expandValue(v.Index(i), fmt.Sprintf("%s[%d]", p, i), errs)
+		}
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			expandValue(v.MapIndex(k), joinKey(p, k.String()), errs)
+		}
+	case reflect.String:
+		s, unset := expandString(v.String())
+		for _, name := range unset {
+			errs.add(p, "variable %s is not set", name)
+		}
+		v.SetString(s)
+	}
+}
+
+// expandString return s with the variables replaced and the variables not set
+func expandString(s string) (string, []string) {
+	var unset []string
+	s = configVarRe.ReplaceAllStringFunc(s, func(m string) string {
+		if m == "$${" {
+			return "${"
+		}
+		sub := configVarRe.FindStringSubmatch(m)
+		if v, ok := os.LookupEnv(sub[1]); ok {
+			return v
+		}
+		if sub[2] != "" {
+			return sub[3]
+		}
+		unset = append(unset, sub[1])
+		return m
+	})
+	return s, unset
+}
+
+// yamlKey return the yaml key of a field
+func yamlKey(f reflect.StructField) string {
+	if name := strings.Split(f.Tag.Get("yaml"), ",")[0]; name != "" {
+		return name
+	}
+	return strings.ToLower(f.Name)
+}
+
+func joinKey(p string, key string) string {
+	if p == "" {
+		return key
+	}
+	return p + "." + key
+}
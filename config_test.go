@@ -1,7 +1,11 @@
 package main
 
 import (
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -9,3 +13,209 @@ func TestConfig(t *testing.T) {
 	c, _ := getConfigFromFile("config.yaml")
 	log.Printf("config %#v\n", c)
 }
+
+func TestDockerfileFrom(t *testing.T) {
+	c, err := getConfigFromFile("config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dockerfile := generateDockerfileContent(c)
+	if !strings.HasPrefix(dockerfile, "FROM ubuntu:20.04 AS ubuntu\n") || !strings.Contains(dockerfile, "linux-image-${KERNEL_VERSION}-generic") {
+		t.Errorf("unexpected dockerfile %s", dockerfile)
+	}
+
+	c.From = "corp/base:1"
+	c.Kernel = ""
+	c.UbuntuVersion = ""
+	if err := c.validateImage(); err != nil {
+		t.Error(err)
+	}
+	dockerfile = generateDockerfileContent(c)
+	if !strings.HasPrefix(dockerfile, "FROM corp/base:1 AS base\n") || strings.Contains(dockerfile, "KERNEL_VERSION") ||
+		!strings.Contains(dockerfile, "chpasswd") || !strings.Contains(dockerfile, "COPY tree/ /") {
+		t.Errorf("unexpected dockerfile %s", dockerfile)
+	}
+
+	c.From = ""
+	if err := c.validateImage(); err == nil {
+		t.Errorf("a config without from should need a kernel")
+	}
+}
+
+func TestRenderBuildContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "d2b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmpl := filepath.Join(dir, "Dockerfile.tmpl")
+	if err := ioutil.WriteFile(tmpl, []byte("FROM {{.From}}\nRUN apt-get install -y {{ join .Packages \" \" }}\n{{ if .Files }}COPY tree/ /\n{{ end }}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{
+		From:               "corp/base:1",
+		Packages:           []string{"curl", "lvm2"},
+		Files:              []File{{Path: "/etc/motd", Mode: "0600", Content: "hello\n"}},
+		DockerfileTemplate: tmpl,
+	}
+	if err := c.validateImage(); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out")
+	if err := renderBuildContext(c, out); err != nil {
+		t.Fatal(err)
+	}
+	dockerfile, err := ioutil.ReadFile(filepath.Join(out, "Dockerfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dockerfile) != "FROM corp/base:1\nRUN apt-get install -y curl lvm2\nCOPY tree/ /\n" {
+		t.Errorf("unexpected dockerfile %s", dockerfile)
+	}
+	info, err := os.Stat(filepath.Join(out, "tree/etc/motd"))
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("tree/etc/motd should be 0600: %v %v", info, err)
+	}
+
+	if err := ioutil.WriteFile(tmpl, []byte("FROM {{.From"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.validateImage(); err == nil {
+		t.Errorf("an invalid template should fail")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "d2b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"base.yaml": `kernel: 5.4.0-58
+ubuntuVersion: 20.04
+packages: [curl]
+vm:
+  cpus: 2
+  memory: 1024
+files:
+  - path: /etc/motd
+    mode: 0600
+    content: base
+`,
+		"app/app.yaml": `include: [../base.yaml]
+login: ${D2B_TEST_LOGIN}:${D2B_TEST_PASSWORD:-secret}
+packages: [nginx]
+vm:
+  memory: 4096
+files:
+  - path: /etc/$${HOME}
+    content: echo ${D2B_TEST_UNSET}
+environments:
+  prod:
+    packages: [prometheus-node-exporter]
+    override:
+      files:
+        - path: /etc/prod
+          content: prod
+`,
+		"a.yaml": "include: [b.yaml]\n",
+		"b.yaml": "include: [a.yaml]\n",
+		"common.yaml": `packages: [curl]
+files:
+  - path: /etc/common
+    mode: 0999
+generalize:
+  disabled: true
+`,
+		"web.yaml":      "include: [common.yaml]\npackages: [nginx]\n",
+		"db.yaml":       "include: [common.yaml]\npackages: [postgresql]\n",
+		"diamond.yaml":  "include: [web.yaml, db.yaml]\ngeneralize:\n  disabled: false\n",
+		"sub/tool.yaml": "files:\n  - path: /usr/bin/tool\n    source: ./bin/tool\n",
+		"tool.yaml":     "include: [sub/tool.yaml]\n",
+		"dotted.yaml":   "environments:\n  prod.eu:\n    target: qemu\n",
+	}
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	app := filepath.Join(dir, "app/app.yaml")
+
+	if _, err := loadConfig(app, "", nil); err == nil || !strings.Contains(err.Error(), "D2B_TEST_LOGIN") {
+		t.Errorf("an unset variable should fail: %v", err)
+	}
+	os.Setenv("D2B_TEST_LOGIN", "admin")
+	defer os.Unsetenv("D2B_TEST_LOGIN")
+
+	c, err := loadConfig(app, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Login != "admin:secret" || strings.Join(c.Packages, " ") != "curl nginx" ||
+		c.VM.CPUs != 2 || c.VM.Memory != 4096 || len(c.Files) != 2 ||
+		c.Files[0].Mode != "0600" || c.Files[1].Path != "/etc/${HOME}" || c.Files[1].Content != "echo ${D2B_TEST_UNSET}" {
+		t.Errorf("unexpected merged config %#v", c)
+	}
+	if c.Include != nil || c.Environments != nil || c.Override != nil {
+		t.Errorf("include, environments and override should be resolved")
+	}
+
+	c, err = loadConfig(app, "prod", []string{"vm.cpus=4", "target=qemu", "packages=[vim]"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(c.Packages, " ") != "vim" || c.VM.CPUs != 4 || c.VM.Memory != 4096 || c.Target != "qemu" ||
+		len(c.Files) != 1 || c.Files[0].Path != "/etc/prod" {
+		t.Errorf("unexpected prod config %#v", c)
+	}
+
+	if _, err := loadConfig(app, "nosuch", nil); err == nil {
+		t.Errorf("an unknown environment should fail")
+	}
+	if _, err := loadConfig(filepath.Join(dir, "dotted.yaml"), "prod.eu", nil); err == nil || !strings.Contains(err.Error(), "dot") {
+		t.Errorf("a dotted environment should fail: %v", err)
+	}
+	if _, err := loadConfig(app, "", []string{"vm.nosuch=1"}); err == nil {
+		t.Errorf("an unknown key should fail")
+	}
+	if _, err := loadConfig(filepath.Join(dir, "a.yaml"), "", nil); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("an include cycle should fail: %v", err)
+	}
+
+	// common.yaml is merged once, false replaces true and the errors have the
+	// line of the included file
+	c, err = loadConfig(filepath.Join(dir, "diamond.yaml"), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(c.Packages, " ") != "curl nginx postgresql" || len(c.Files) != 1 || c.Generalize.Disabled {
+		t.Errorf("unexpected diamond config %#v", c)
+	}
+	want := filepath.Join(dir, "common.yaml") + ":4: files[0].mode: invalid mode"
+	if err := c.validate(); err == nil || !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("error %v, want %s", err, want)
+	}
+	c, err = loadConfig(filepath.Join(dir, "common.yaml"), "", []string{"generalize.disabled=false"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Generalize.Disabled {
+		t.Errorf("-set should set false")
+	}
+
+	// sources are relative to the config of the file
+	c, err = loadConfig(filepath.Join(dir, "tool.yaml"), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tool := filepath.Join(dir, "sub/bin/tool")
+	if c.Files[0].Source != tool {
+		t.Errorf("source %s, want %s", c.Files[0].Source, tool)
+	}
+	if err := c.validate(); err == nil || !strings.Contains(err.Error(), "files[0].source") {
+		t.Errorf("a missing source should fail: %v", err)
+	}
+}
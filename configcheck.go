@@ -0,0 +1,358 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// the config is checked before the image is built, so that a mistake is not
+// found after a long build. All the errors are reported, with the line of the
+// key in the config file, see config.schema.json for the structure.
+
+// fieldError is an error of the value at a key path, e.g. files[0].mode
+type fieldError struct {
+	path string
+	msg  string
+}
+
+// configErrors are all the errors of a config
+type configErrors struct {
+	source string
+	lines  map[string]configLine
+	errors []fieldError
+}
+
+func (e *configErrors) add(path string, format string, a ...interface{}) {
+	e.errors = append(e.errors, fieldError{path, fmt.Sprintf(format, a...)})
+}
+
+func (e *configErrors) addErr(path string, err error) {
+	if err != nil {
+		e.add(path, "%s", err)
+	}
+}
+
+// line return the file and line of path or of its closest parent, false if
+// unknown, e.g. a value set by a flag
+func (e *configErrors) line(p string) (configLine, bool) {
+	for p != "" {
+		if l, ok := e.lines[p]; ok {
+			return l, true
+		}
+		i := strings.LastIndexAny(p, ".[")
+		if i < 0 {
+			break
+		}
+		p = p[:i]
+	}
+	return configLine{}, false
+}
+
+func (e *configErrors) Error() string {
+	var b strings.Builder
+	for i, fe := range e.errors {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		if l, ok := e.line(fe.path); ok {
+			b.WriteString(l.file + ":")
+			if l.line > 0 {
+				b.WriteString(strconv.Itoa(l.line) + ":")
+			}
+			b.WriteString(" ")
+		} else if e.source != "" {
+			b.WriteString(e.source + ": ")
+		}
+		b.WriteString(fe.path + ": " + fe.msg)
+	}
+	return b.String()
+}
+
+// err return nil if there is no error
+func (e *configErrors) err() error {
+	if len(e.errors) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (c *Config) errors() *configErrors {
+	return &configErrors{source: c.source, lines: c.lines}
+}
+
+var yamlLineRe = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// yamlErrors report the errors of yaml.UnmarshalStrict as file:line: error
+func yamlErrors(file string, err error) error {
+	msgs := []string{err.Error()}
+	if te, ok := err.(*yaml.TypeError); ok {
+		msgs = te.Errors
+	}
+	for i, msg := range msgs {
+		msg = strings.TrimPrefix(msg, "yaml: ")
+		if m := yamlLineRe.FindStringSubmatch(msg); m != nil {
+			msgs[i] = file + ":" + m[1] + ": " + m[2]
+		} else {
+			msgs[i] = file + ": " + msg
+		}
+	}
+	return fmt.Errorf("%s", strings.Join(msgs, "\n"))
+}
+
+var yamlKeyRe = regexp.MustCompile(`^("[^"]*"|'[^']*'|[^\s#'"{}\[\]][^:#]*?):(\s+(.*))?$`)
+
+// yamlLines return the line of the keys and list items of a block style yaml
+// by their path, e.g. files[0].mode. Flow style collections and the content
+// of block scalars are not indexed.
+func yamlLines(data []byte) map[string]int {
+	type frame struct {
+		indent int
+		path   string
+		item   bool
+	}
+	lines := map[string]int{}
+	items := map[string]int{}
+	var stack []frame
+	// block scalars are skipped until a line with an indent <= scalarIndent
+	scalarIndent := -1
+
+	top := func() string {
+		if len(stack) == 0 {
+			return ""
+		}
+		return stack[len(stack)-1].path
+	}
+	for n, line := range strings.Split(string(data), "\n") {
+		content := strings.TrimLeft(line, " ")
+		indent := len(line) - len(content)
+		content = strings.TrimRight(content, " \t\r")
+		if content == "" {
+			continue
+		}
+		if scalarIndent >= 0 {
+			if indent > scalarIndent {
+				continue
+			}
+			scalarIndent = -1
+		}
+		if strings.HasPrefix(content, "#") || content == "---" {
+			continue
+		}
+
+		for strings.HasPrefix(content, "-") && (len(content) == 1 || content[1] == ' ') {
+			// pop the keys of the previous item and the previous item itself
+			for len(stack) > 0 {
+				f := stack[len(stack)-1]
+				if f.indent < indent || (f.indent == indent && !f.item) {
+					break
+				}
+				stack = stack[:len(stack)-1]
+			}
+			parent := top()
+			p := fmt.Sprintf("%s[%d]", parent, items[parent])
+			items[parent]++
+			lines[p] = n + 1
+			stack = append(stack, frame{indent, p, true})
+			rest := strings.TrimLeft(content[1:], " ")
+			indent += len(content) - len(rest)
+			content = rest
+		}
+
+		m := yamlKeyRe.FindStringSubmatch(content)
+		if m == nil {
+			continue
+		}
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		key := strings.Trim(m[1], `"'`)
+		p := key
+		if parent := top(); parent != "" {
+			p = parent + "." + key
+		}
+		lines[p] = n + 1
+		stack = append(stack, frame{indent, p, false})
+		if strings.HasPrefix(m[3], "|") || strings.HasPrefix(m[3], ">") {
+			scalarIndent = indent
+		}
+	}
+	return lines
+}
+
+var (
+	kernelVersionRe = regexp.MustCompile(`^\d+\.\d+\.\d+-\d+$`)
+	// a tag of the ubuntu image, e.g. 20.04 or focal
+	ubuntuVersionRe = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	packageNameRe   = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]*(:[a-z0-9-]+)?(=\S+)?$`)
+)
+
+// validateMode check mode is an octal file mode, e.g. 0644
+func validateMode(mode string) error {
+	if m, err := strconv.ParseUint(mode, 8, 32); err != nil || m > 07777 {
+		return fmt.Errorf("invalid mode %q, should be octal, e.g. 0644", mode)
+	}
+	return nil
+}
+
+// validateSource check the host file or directory p exists
+func validateSource(p string) error {
+	if _, err := os.Stat(p); err != nil {
+		return fmt.Errorf("source %s", err)
+	}
+	return nil
+}
+
+func validateAbsPath(p string) error {
+	if !path.IsAbs(p) {
+		return fmt.Errorf("%q should be an absolute path", p)
+	}
+	return nil
+}
+
+// validate check the values of the config, all the errors are returned as a
+// *configErrors
+func (c *Config) validate() error {
+	errs := c.errors()
+	c.checkValues(errs)
+	return errs.err()
+}
+
+// validateImage check the config and that the image can be built from it
+func (c *Config) validateImage() error {
+	errs := c.errors()
+	c.checkValues(errs)
+	if c.From == "" {
+		if c.Kernel == "" {
+			errs.add("kernel", "is needed without from")
+		}
+		if c.UbuntuVersion == "" {
+			errs.add("ubuntuVersion", "is needed without from")
+		}
+	}
+	if _, err := parseDockerfileTemplate(c); err != nil {
+		errs.add("dockerfileTemplate", "invalid template %s", err)
+	}
+	return errs.err()
+}
+
+func (c *Config) checkValues(errs *configErrors) {
+	if strings.ContainsAny(c.From, " \t\n") {
+		errs.add("from", "invalid image %q", c.From)
+	}
+	if c.Kernel != "" && !kernelVersionRe.MatchString(c.Kernel) {
+		errs.add("kernel", "invalid version %q, should be like 5.4.0-58, -generic is added", c.Kernel)
+	}
+	if c.UbuntuVersion != "" && !ubuntuVersionRe.MatchString(c.UbuntuVersion) {
+		errs.add("ubuntuVersion", "invalid version %q, should be a tag of the ubuntu image like 20.04 or focal", c.UbuntuVersion)
+	}
+	if c.Login != "" {
+		// passed to chpasswd in a single quoted string
+		kv := strings.SplitN(c.Login, ":", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" || strings.ContainsAny(c.Login, "'\n") {
+			errs.add("login", "should be <user>:<password>, both not empty and without quote")
+		}
+	}
+	for i, p := range c.Packages {
+		if !packageNameRe.MatchString(p) {
+			errs.add(fmt.Sprintf("packages[%d]", i), "invalid package name %q", p)
+		}
+	}
+	for i, u := range c.Systemd.Units {
+		if u.Name == "" {
+			errs.add(fmt.Sprintf("systemd.units[%d].name", i), "should not be empty")
+		}
+	}
+
+	files := map[string]bool{}
+	for i, f := range c.Files {
+		p := fmt.Sprintf("files[%d]", i)
+		errs.addErr(p+".path", validateAbsPath(f.Path))
+		if files[f.Path] {
+			errs.add(p+".path", "duplicated file %s", f.Path)
+		}
+		files[f.Path] = true
+		if f.Mode != "" {
+			errs.addErr(p+".mode", validateMode(f.Mode))
+		}
+		if err := f.validate(); err != nil {
+			errs.addErr(p, err)
+		} else if f.Source != "" {
+			errs.addErr(p+".source", validateSource(f.Source))
+		}
+	}
+	for i := range c.Contents {
+		cs := &c.Contents[i]
+		p := fmt.Sprintf("contents[%d]", i)
+		if err := cs.validate(); err != nil {
+			errs.addErr(p, err)
+		} else if cs.Type != ContentTypeImage {
+			errs.addErr(p+".source", validateSource(cs.Source))
+		}
+	}
+	for i, add := range c.Add {
+		p := fmt.Sprintf("add[%d]", i)
+		if add.Source == "" {
+			errs.add(p+".source", "should not be empty")
+		} else {
+			errs.addErr(p+".source", validateSource(add.Source))
+		}
+		errs.addErr(p+".dest", validateAbsPath(add.Dest))
+		if add.Mode != "" {
+			errs.addErr(p+".mode", validateMode(add.Mode))
+		}
+	}
+	for i := range c.Customize {
+		p := fmt.Sprintf("customize[%d]", i)
+		cust := &c.Customize[i]
+		if err := cust.validate(); err != nil {
+			errs.addErr(p, err)
+			continue
+		}
+		if cust.Script != "" {
+			errs.addErr(p+".script", validateSource(cust.Script))
+		}
+		if cust.Edit != nil {
+			errs.addErr(p+".edit.path", validateAbsPath(cust.Edit.Path))
+		}
+		if cust.Link != nil {
+			errs.addErr(p+".link.path", validateAbsPath(cust.Link.Path))
+		}
+	}
+	names := map[string]bool{}
+	for i := range c.Firstboot {
+		f := &c.Firstboot[i]
+		p := fmt.Sprintf("firstboot[%d]", i)
+		if err := f.validate(); err != nil {
+			errs.addErr(p, err)
+		} else if f.Script != "" {
+			errs.addErr(p+".script", validateSource(f.Script))
+		}
+		if names[f.Name] {
+			errs.add(p+".name", "duplicated name %s", f.Name)
+		}
+		names[f.Name] = true
+	}
+	if c.CloudInit != nil {
+		errs.addErr("cloudInit", c.CloudInit.validate())
+	}
+	errs.addErr("generalize", c.Generalize.validate())
+	if _, err := c.target(); err != nil {
+		errs.addErr("target", err)
+	}
+	if c.VM != nil {
+		for _, v := range []struct {
+			name  string
+			value int
+		}{{"cpus", c.VM.CPUs}, {"memory", c.VM.Memory}, {"nics", c.VM.NICs}} {
+			if v.value < 0 {
+				errs.add("vm."+v.name, "should not be negative")
+			}
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const checkedConfig = `# comment
+kernel: 5.4.0
+ubuntuVersion: 20.04
+login: root
+packages:
+  - curl
+  - "bad name"
+files:
+  - path: /etc/motd
+    content: |
+      mode: not a key
+  - path: etc/issue
+    mode: 0999
+customize:
+- run: systemctl enable a
+- link:
+    path: relative
+    target: /a
+`
+
+func TestYamlLines(t *testing.T) {
+	lines := yamlLines([]byte(checkedConfig))
+	for p, n := range map[string]int{
+		"kernel":                 2,
+		"packages[1]":            7,
+		"files[0].path":          9,
+		"files[0].content":       10,
+		"files[1]":               12,
+		"files[1].mode":          13,
+		"customize[0].run":       15,
+		"customize[1].link.path": 17,
+	} {
+		if lines[p] != n {
+			t.Errorf("line of %s is %d, want %d", p, lines[p], n)
+		}
+	}
+	if _, ok := lines["files[0].content.mode"]; ok {
+		t.Errorf("block scalar content should not be indexed")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "d2b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(file, []byte(checkedConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := getConfigFromFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.validateImage()
+	if err == nil {
+		t.Fatal("config should be invalid")
+	}
+	want := []string{
+		file + ":2: kernel: invalid version",
+		file + ":4: login: should be <user>:<password>",
+		file + ":7: packages[1]: invalid package name",
+		file + ":12: files[1].path: \"etc/issue\" should be an absolute path",
+		file + ":13: files[1].mode: invalid mode \"0999\"",
+		file + ":17: customize[1].link.path: \"relative\" should be an absolute path",
+	}
+	msgs := strings.Split(err.Error(), "\n")
+	if len(msgs) != len(want) {
+		t.Fatalf("errors %s, want %d errors", err, len(want))
+	}
+	for i := range want {
+		if !strings.HasPrefix(msgs[i], want[i]) {
+			t.Errorf("error %s, want %s", msgs[i], want[i])
+		}
+	}
+
+	c, _ = getConfigFromFile("config.yaml")
+	if err := c.validateImage(); err != nil {
+		t.Error(err)
+	}
+
+	c.UbuntuVersion = "focal"
+	c.Packages = []string{"libc6:i386", "curl=7.68.0-1ubuntu2"}
+	if err := c.validateImage(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStrictConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "d2b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(file, []byte("kernel: 5.4.0-58\npackage:\n  - curl\nfiles:\n  - path: /a\n    mod: 0644\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = getConfigFromFile(file)
+	if err == nil {
+		t.Fatal("unknown keys should fail")
+	}
+	msgs := strings.Split(err.Error(), "\n")
+	if len(msgs) != 2 || !strings.HasPrefix(msgs[0], file+":2: field package not found") || !strings.HasPrefix(msgs[1], file+":6: field mod not found") {
+		t.Errorf("unexpected error %s", err)
+	}
+}
+
+// the schema should describe the keys of the config
+func TestConfigSchema(t *testing.T) {
+	data, err := ioutil.ReadFile("config.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatal(err)
+	}
+	checkSchemaKeys(t, "config", schema, reflect.TypeOf(Config{}))
+
+	props := schema["properties"].(map[string]interface{})
+	var names []string
+	for _, n := range props["target"].(map[string]interface{})["enum"].([]interface{}) {
+		names = append(names, n.(string))
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, targetNames()) {
+		t.Errorf("schema targets %v, want %v", names, targetNames())
+	}
+	ops := schema["definitions"].(map[string]interface{})["generalizeOperation"].(map[string]interface{})["enum"].([]interface{})
+	if len(ops) != len(generalizeOperations) {
+		t.Errorf("schema generalize operations %v", ops)
+	}
+}
+
+func checkSchemaKeys(t *testing.T, name string, schema map[string]interface{}, typ reflect.Type) {
+	for typ.Kind() == reflect.Ptr || typ.Kind() == reflect.Slice {
+		typ = typ.Elem()
+		if items, ok := schema["items"]; ok {
+			schema = items.(map[string]interface{})
+		}
+	}
+	if typ.Kind() != reflect.Struct {
+		return
+	}
+	props, _ := schema["properties"].(map[string]interface{})
+	keys := map[string]bool{}
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		key := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if key == "" {
+			continue
+		}
+		keys[key] = true
+		prop, ok := props[key].(map[string]interface{})
+		if !ok {
+			t.Errorf("%s.%s is not in the schema", name, key)
+			continue
+		}
+		// a reference to the config itself
+		if _, ok := prop["$ref"]; !ok {
+			checkSchemaKeys(t, name+"."+key, prop, f.Type)
+		}
+	}
+	for key := range props {
+		if !keys[key] {
+			t.Errorf("%s.%s of the schema is not in the config", name, key)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/binchenx/guestfs"
+	"github.com/docker/docker/pkg/archive"
+)
+
+// content sources copied to the disk, from the config or the command line
+
+const (
+	// ContentTypeTar is a tarball on the host
+	ContentTypeTar = "tar"
+	// ContentTypeDir is a directory on the host, its content is copied
+	ContentTypeDir = "dir"
+	// ContentTypeImage is a docker image, the filesystem of the image is copied
+	ContentTypeImage = "image"
+	// ContentTypeCopy is a host file or directory copied to a path, see Addition
+	ContentTypeCopy = "copy"
+)
+
+// contentFlags collect the repeated -content flags
+type contentFlags []ContentSource
+
+func (c *contentFlags) String() string {
+	var s []string
+	for _, cs := range *c {
+		s = append(s, fmt.Sprintf("%#v", cs))
+	}
+	return strings.Join(s, " ")
+}
+
+// Set parse type=<type>,source=<source>[,dest=<dir>][,partition=<name>]
+func (c *contentFlags) Set(value string) error {
+	var cs ContentSource
+	for _, kv := range strings.Split(value, ",") {
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) != 2 {
+			return fmt.Errorf("invalid content %s, expect key=value", kv)
+		}
+		switch pair[0] {
+		case "type":
+			cs.Type = pair[1]
+		case "source":
+			cs.Source = pair[1]
+		case "dest":
+			cs.DestDir = pair[1]
+		case "partition":
+			cs.Partition = pair[1]
+		default:
+			return fmt.Errorf("unknown content key %s", pair[0])
+		}
+	}
+
+	*c = append(*c, cs)
+	return nil
+}
+
+// additionFlags collect the repeated -add flags
+type additionFlags []Addition
+
+func (a *additionFlags) String() string {
+	var s []string
+	for _, add := range *a {
+		s = append(s, fmt.Sprintf("%#v", add))
+	}
+	return strings.Join(s, " ")
+}
+
+// Set parse <host path>:<guest path>[:<owner>[:<group>[:<mode>]]]
+func (a *additionFlags) Set(value string) error {
+	fields := strings.Split(value, ":")
+	if len(fields) < 2 || len(fields) > 5 {
+		return fmt.Errorf("invalid add %s, expect host:guest[:owner[:group[:mode]]]", value)
+	}
+
+	add := Addition{Source: fields[0], Dest: fields[1]}
+	if len(fields) > 2 {
+		add.Owner = fields[2]
+	}
+	if len(fields) > 3 {
+		add.Group = fields[3]
+	}
+	if len(fields) > 4 {
+		add.Mode = fields[4]
+	}
+
+	*a = append(*a, add)
+	return nil
+}
+
+// resolveAdditions turn the additions into contents to copy
+func resolveAdditions(additions []Addition) ([]Content, error) {
+	var contents []Content
+	for _, add := range additions {
+		if !path.IsAbs(add.Dest) {
+			return nil, fmt.Errorf("add %s: %s should be an absolute path", add.Source, add.Dest)
+		}
+		if add.Mode != "" {
+			if _, err := strconv.ParseUint(add.Mode, 8, 32); err != nil {
+				return nil, fmt.Errorf("add %s: invalid mode %s", add.Source, add.Mode)
+			}
+		}
+		if _, err := os.Stat(add.Source); err != nil {
+			return nil, err
+		}
+
+		contents = append(contents, Content{
+			source:     add.Source,
+			sourceType: ContentTypeCopy,
+			destDir:    add.Dest,
+			owner:      add.Owner,
+			group:      add.Group,
+			mode:       add.Mode,
+		})
+	}
+	return contents, nil
+}
+
+// validate the content source without accessing the sources
+func (cs *ContentSource) validate() error {
+	switch cs.Type {
+	case ContentTypeTar, ContentTypeDir, ContentTypeImage:
+	default:
+		return fmt.Errorf("content %s: unknown type %q", cs.Source, cs.Type)
+	}
+	if cs.Source == "" {
+		return fmt.Errorf("content of type %s without source", cs.Type)
+	}
+	if cs.DestDir != "" && !path.IsAbs(cs.DestDir) {
+		return fmt.Errorf("content %s: dest %s should be an absolute path", cs.Source, cs.DestDir)
+	}
+	return nil
+}
+
+// resolveContents turn the content sources into contents to copy, docker
+// images are unpacked to tarballs
+func resolveContents(sources []ContentSource) ([]Content, error) {
+	var contents []Content
+	for _, cs := range sources {
+		if err := cs.validate(); err != nil {
+			return nil, err
+		}
+
+		c := Content{
+			source:     cs.Source,
+			sourceType: cs.Type,
+			destDir:    cs.DestDir,
+			partition:  cs.Partition,
+		}
+		if c.destDir == "" {
+			c.destDir = "/"
+		}
+
+		switch cs.Type {
+		case ContentTypeImage:
+			tar, err := UnpackDockerImage(cs.Source)
+			if err != nil {
+				return nil, fmt.Errorf("fail to unpack docker image %s: %s", cs.Source, err)
+			}
+			c.source = tar
+			c.sourceType = ContentTypeTar
+		case ContentTypeDir:
+			info, err := os.Stat(cs.Source)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				return nil, fmt.Errorf("content %s is not a directory", cs.Source)
+			}
+		case ContentTypeTar:
+			if _, err := os.Stat(cs.Source); err != nil {
+				return nil, err
+			}
+		}
+
+		contents = append(contents, c)
+	}
+
+	return contents, nil
+}
+
+// tarHostDir create a tarball with the content of dir, the caller should
+// remove it
+func tarHostDir(dir string) (string, error) {
+	tar, err := archive.TarWithOptions(dir, &archive.TarOptions{})
+	if err != nil {
+		return "", err
+	}
+	defer tar.Close()
+
+	f, err := ioutil.TempFile(os.TempDir(), "d2b-dir*.tar")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, tar); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// copyInHostPath copy the host file or directory of c to c.destDir and set the
+// owner and mode
+func copyInHostPath(g *guestfs.Guestfs, c Content) error {
+	info, err := os.Stat(c.source)
+	if err != nil {
+		return err
+	}
+
+	dest := c.destDir
+	if err := g.Mkdir_p(path.Dir(dest)); err != nil {
+		return fmt.Errorf("%s", err.Errmsg)
+	}
+
+	if info.IsDir() {
+		// merge with the directory if it exists
+		if err := g.Mkdir_p(dest); err != nil {
+			return fmt.Errorf("%s", err.Errmsg)
+		}
+		tarFile, err := tarHostDir(c.source)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tarFile)
+		if err := g.Tar_in(tarFile, dest, nil); err != nil {
+			return fmt.Errorf("%s", err.Errmsg)
+		}
+	} else {
+		// copy-in keeps the name, copy to a temporary directory and rename
+		tmpDir := "/.d2b-add"
+		if err := g.Mkdir_p(tmpDir); err != nil {
+			return fmt.Errorf("%s", err.Errmsg)
+		}
+		if err := g.Copy_in(c.source, tmpDir); err != nil {
+			return fmt.Errorf("%s", err.Errmsg)
+		}
+		if err := g.Mv(path.Join(tmpDir, path.Base(c.source)), dest); err != nil {
+			return fmt.Errorf("%s", err.Errmsg)
+		}
+		if err := g.Rmdir(tmpDir); err != nil {
+			return fmt.Errorf("%s", err.Errmsg)
+		}
+	}
+
+	if c.owner != "" || c.group != "" {
+		uid, gid := -1, -1
+		if c.owner != "" {
+			if uid, err = lookupGuestID(g, "/etc/passwd", c.owner); err != nil {
+				return err
+			}
+		}
+		if c.group != "" {
+			if gid, err = lookupGuestID(g, "/etc/group", c.group); err != nil {
+				return err
+			}
+		}
+
+		paths := []string{dest}
+		if info.IsDir() {
+			files, err := g.Find(dest)
+			if err != nil {
+				return fmt.Errorf("%s", err.Errmsg)
+			}
+			for _, f := range files {
+				paths = append(paths, path.Join(dest, f))
+			}
+		}
+		for _, p := range paths {
+			if err := g.Lchown(uid, gid, p); err != nil {
+				return fmt.Errorf("%s", err.Errmsg)
+			}
+		}
+	}
+
+	if c.mode != "" {
+		mode, _ := strconv.ParseUint(c.mode, 8, 32)
+		if err := g.Chmod(int(mode), dest); err != nil {
+			return fmt.Errorf("%s", err.Errmsg)
+		}
+	}
+
+	log.Printf("[Info]   Add %s to %s\n", c.source, dest)
+	return nil
+}
+
+// lookupGuestID return the id of user or group name in the passwd or group
+// file of the guest, a numeric name is returned as it is
+func lookupGuestID(g *guestfs.Guestfs, file string, name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+
+	data, gerr := g.Cat(file)
+	if gerr != nil {
+		return 0, fmt.Errorf("%s", gerr.Errmsg)
+	}
+	id, ok := parseIDFile(data, name)
+	if !ok {
+		return 0, fmt.Errorf("%s not found in %s of the image", name, file)
+	}
+	return id, nil
+}
+
+// parseIDFile find the id of name in the content of a passwd or group file
+func parseIDFile(data string, name string) (int, bool) {
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) > 2 && fields[0] == name {
+			id, err := strconv.Atoi(fields[2])
+			return id, err == nil
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestContentFlags(t *testing.T) {
+	var c contentFlags
+	if err := c.Set("type=image,source=binc/data:latest,dest=/,partition=data"); err != nil {
+		t.Fatal(err)
+	}
+	expected := ContentSource{Type: ContentTypeImage, Source: "binc/data:latest", DestDir: "/", Partition: "data"}
+	if c[0] != expected {
+		t.Errorf("unexpected content %#v", c[0])
+	}
+
+	if err := c.Set("type=tar,src=rootfs.tar"); err == nil {
+		t.Errorf("expected error for unknown key")
+	}
+}
+
+func TestResolveContents(t *testing.T) {
+	dir := t.TempDir()
+	contents, err := resolveContents([]ContentSource{{Type: ContentTypeDir, Source: dir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents[0].destDir != "/" || contents[0].sourceType != ContentTypeDir {
+		t.Errorf("unexpected content %#v", contents[0])
+	}
+
+	if _, err := resolveContents([]ContentSource{{Type: "zip", Source: dir}}); err == nil {
+		t.Errorf("expected error for unknown type")
+	}
+
+	if _, err := resolveContents([]ContentSource{{Type: ContentTypeTar, Source: dir, DestDir: "data"}}); err == nil {
+		t.Errorf("expected error for relative dest")
+	}
+}
+
+func TestAdditionFlags(t *testing.T) {
+	var a additionFlags
+	if err := a.Set("./id_rsa:/root/.ssh/id_rsa:root:root:0600"); err != nil {
+		t.Fatal(err)
+	}
+	expected := Addition{Source: "./id_rsa", Dest: "/root/.ssh/id_rsa", Owner: "root", Group: "root", Mode: "0600"}
+	if a[0] != expected {
+		t.Errorf("unexpected addition %#v", a[0])
+	}
+
+	if err := a.Set("./id_rsa"); err == nil {
+		t.Errorf("expected error without guest path")
+	}
+
+	if _, err := resolveAdditions([]Addition{{Source: t.TempDir(), Dest: "/opt", Mode: "0999"}}); err == nil {
+		t.Errorf("expected error for invalid mode")
+	}
+
+	contents, err := resolveAdditions([]Addition{{Source: t.TempDir(), Dest: "/opt/app", Owner: "app"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents[0].sourceType != ContentTypeCopy || contents[0].destDir != "/opt/app" || contents[0].owner != "app" {
+		t.Errorf("unexpected content %#v", contents[0])
+	}
+}
+
+func TestParseIDFile(t *testing.T) {
+	passwd := "root:x:0:0:root:/root:/bin/bash\nsyslog:x:104:110::/home/syslog:/usr/sbin/nologin\n"
+	if id, ok := parseIDFile(passwd, "syslog"); !ok || id != 104 {
+		t.Errorf("expected 104 got %d", id)
+	}
+	if _, ok := parseIDFile(passwd, "nobody"); ok {
+		t.Errorf("nobody should not be found")
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/binchenx/guestfs"
+)
+
+// customizations run in the guest after the contents are copied, see Customization
+
+// validate make sure exactly one action is set
+func (c *Customization) validate() error {
+	var actions []string
+	if c.Run != "" {
+		actions = append(actions, "run")
+	}
+	if c.Script != "" {
+		actions = append(actions, "script")
+	}
+	if len(c.Install) != 0 {
+		actions = append(actions, "install")
+	}
+	if c.Edit != nil {
+		actions = append(actions, "edit")
+		if c.Edit.Path == "" || c.Edit.Expression == "" {
+			return fmt.Errorf("customize edit needs a path and an expression")
+		}
+	}
+	if c.Link != nil {
+		actions = append(actions, "link")
+		if c.Link.Path == "" || c.Link.Target == "" {
+			return fmt.Errorf("customize link needs a path and a target")
+		}
+	}
+
+	if len(actions) != 1 {
+		return fmt.Errorf("customize entry should have exactly one of run, script, install, edit and link, found %v", actions)
+	}
+	return nil
+}
+
+// customizeNeedNetwork tell if the appliance needs network, which must be
+// enabled before it is launched
+func customizeNeedNetwork(customizations []Customization) bool {
+	for _, c := range customizations {
+		if len(c.Install) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// customizeGuest run the steps of the config once the contents are copied
+func customizeGuest(g *guestfs.Guestfs, config *Config, diskLayout *DiskLayout) {
+	if err := runCustomizations(g, config.Customize); err != nil {
+		log.Fatalf("Fail to customize the guest %s\n", err)
+	}
+	installFirstboot(g, config.Firstboot)
+	installCloudInit(g, config.CloudInit, diskLayout)
+}
+
+// appliance dns when the network is enabled
+const applianceResolvConf = "nameserver 169.254.2.3\n"
+
+// runCustomizations run the customizations in order, the first failure stop
+// the build
+func runCustomizations(g *guestfs.Guestfs, customizations []Customization) error {
+	if len(customizations) == 0 {
+		return nil
+	}
+
+	log.Println("[Info] Customize")
+	for i, c := range customizations {
+		if err := c.validate(); err != nil {
+			return err
+		}
+
+		var out string
+		var err error
+		switch {
+		case c.Run != "":
+			log.Printf("[Info]   run %s\n", c.Run)
+			out, err = guestSh(g, c.Run)
+		case c.Script != "":
+			log.Printf("[Info]   script %s\n", c.Script)
+			out, err = runHostScript(g, c.Script, i)
+		case len(c.Install) != 0:
+			log.Printf("[Info]   install %s\n", strings.Join(c.Install, " "))
+			out, err = installPackages(g, c.Install)
+		case c.Edit != nil:
+			log.Printf("[Info]   edit %s %s\n", c.Edit.Path, c.Edit.Expression)
+			out, err = guestCommand(g, []string{"sed", "-i", "-e", c.Edit.Expression, c.Edit.Path})
+		case c.Link != nil:
+			log.Printf("[Info]   link %s -> %s\n", c.Link.Path, c.Link.Target)
+			err = guestLink(g, c.Link.Target, c.Link.Path)
+		}
+
+		for _, line := range strings.Split(strings.TrimRight(out, "\n"), "\n") {
+			if line != "" {
+				log.Printf("[Info]     %s\n", line)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("customize #%d failed: %s", i+1, err)
+		}
+	}
+	log.Println("[Info] Customize DONE")
+
+	return nil
+}
+
+func guestSh(g *guestfs.Guestfs, command string) (string, error) {
+	out, err := g.Sh(command)
+	if err != nil {
+		return out, fmt.Errorf("%s", err.Errmsg)
+	}
+	return out, nil
+}
+
+func guestCommand(g *guestfs.Guestfs, args []string) (string, error) {
+	out, err := g.Command(args)
+	if err != nil {
+		return out, fmt.Errorf("%s", err.Errmsg)
+	}
+	return out, nil
+}
+
+func guestLink(g *guestfs.Guestfs, target string, link string) error {
+	if err := g.Mkdir_p(path.Dir(link)); err != nil {
+		return fmt.Errorf("%s", err.Errmsg)
+	}
+	if err := g.Ln_sf(target, link); err != nil {
+		return fmt.Errorf("%s", err.Errmsg)
+	}
+	return nil
+}
+
+// upload the host script and run it
+func runHostScript(g *guestfs.Guestfs, script string, index int) (string, error) {
+	guestScript := fmt.Sprintf("/tmp/d2b-customize-%d", index)
+	if err := g.Mkdir_p("/tmp"); err != nil {
+		return "", fmt.Errorf("%s", err.Errmsg)
+	}
+	if err := g.Upload(script, guestScript); err != nil {
+		return "", fmt.Errorf("%s", err.Errmsg)
+	}
+	defer g.Rm_f(guestScript)
+	if err := g.Chmod(0755, guestScript); err != nil {
+		return "", fmt.Errorf("%s", err.Errmsg)
+	}
+	return guestCommand(g, []string{guestScript})
+}
+
+// install packages with apt, using the appliance dns while installing
+func installPackages(g *guestfs.Guestfs, packages []string) (string, error) {
+	const resolvConf = "/etc/resolv.conf"
+	const resolvConfSaved = "/etc/resolv.conf.d2b"
+
+	// resolv.conf is usually a dangling symlink to the systemd-resolved stub
+	exists, gerr := g.Exists(resolvConf)
+	if gerr != nil {
+		return "", fmt.Errorf("%s", gerr.Errmsg)
+	}
+	isLink, _ := g.Is_symlink(resolvConf)
+	if exists || isLink {
+		if err := g.Mv(resolvConf, resolvConfSaved); err != nil {
+			return "", fmt.Errorf("%s", err.Errmsg)
+		}
+		defer g.Mv(resolvConfSaved, resolvConf)
+	} else {
+		defer g.Rm_f(resolvConf)
+	}
+	if err := g.Write(resolvConf, []byte(applianceResolvConf)); err != nil {
+		return "", fmt.Errorf("%s", err.Errmsg)
+	}
+
+	return guestSh(g, "export DEBIAN_FRONTEND=noninteractive && apt-get update && "+
+		"apt-get install --no-install-recommends -y "+strings.Join(packages, " "))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestCustomizations(t *testing.T) {
+	data := `
+customize:
+  - run: systemctl mask apt-daily.timer
+  - install: [nginx, jq]
+  - edit:
+      path: /etc/ssh/sshd_config
+      expression: s/^#Port 22/Port 2222/
+  - link:
+      path: /etc/nginx/sites-enabled/app
+      target: /etc/nginx/sites-available/app
+`
+	var c Config
+	if err := yaml.Unmarshal([]byte(data), &c); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Customize) != 4 {
+		t.Fatalf("unexpected customizations %#v", c.Customize)
+	}
+	for _, cu := range c.Customize {
+		if err := cu.validate(); err != nil {
+			t.Errorf("unexpected error %s", err)
+		}
+	}
+	if !customizeNeedNetwork(c.Customize) || customizeNeedNetwork(c.Customize[:1]) {
+		t.Errorf("network should only be needed to install packages")
+	}
+
+	invalid := []Customization{
+		{},
+		{Run: "true", Script: "setup.sh"},
+		{Edit: &FileEdit{Path: "/etc/hosts"}},
+		{Link: &Symlink{Target: "/bin/bash"}},
+	}
+	for _, cu := range invalid {
+		if err := cu.validate(); err == nil {
+			t.Errorf("expected error for %#v", cu)
+		}
+	}
+}
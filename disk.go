@@ -1,12 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"log"
 	"os"
+	"path"
 	"sort"
 	"strconv"
-	"strings"
 
 	"github.com/binchenx/guestfs"
 )
@@ -14,8 +16,15 @@ import (
 // create disk image with specified disk layout and source content using libguestfs
 type Content struct {
 	source     string
-	sourceType string // support tar only atm
+	sourceType string // ContentTypeTar, ContentTypeDir or ContentTypeCopy
 	destDir    string
+	// partition is the name of the partition to copy to, destDir is relative to
+	// the root of the partition. If empty destDir is relative to the rootfs.
+	partition string
+	// owner, group and mode override the ones of a ContentTypeCopy content
+	owner string
+	group string
+	mode  string
 }
 
 type Disk struct {
@@ -25,9 +34,14 @@ type Disk struct {
 }
 
 // source point to the content for root parition
-func CreateBootableImage(diskImage Disk, diskLayout *DiskLayout, contents *[]Content, debug bool) {
+func CreateBootableImage(diskImage Disk, diskLayout *DiskLayout, contents *[]Content, config *Config, debug bool) {
 	log.Printf("[Info]create %s\n", diskImage.Name)
 
+	target, terr := config.target()
+	if terr != nil {
+		log.Fatal(terr)
+	}
+
 	if diskLayout.ParitionType != PartitionTypeGpt {
 		log.Fatalf("partition type is not gpt: %s\n ", diskLayout.ParitionType)
 	}
@@ -66,6 +80,13 @@ func CreateBootableImage(diskImage Disk, diskLayout *DiskLayout, contents *[]Con
 		panic(err)
 	}
 
+	// installing packages in the guest needs network
+	if customizeNeedNetwork(config.Customize) {
+		if err := g.Set_network(true); err != nil {
+			panic(err)
+		}
+	}
+
 	// Run the libguestfs back-end.
 	if err := g.Launch(); err != nil {
 		panic(err)
@@ -83,10 +104,25 @@ func CreateBootableImage(diskImage Disk, diskLayout *DiskLayout, contents *[]Con
 	device := devices[0]
 
 	partitionDiskAndCreateFs(g, device, diskLayout)
+	createVolumeGroups(g, device, diskLayout)
 	setupRootfs(g, device, diskLayout)
-	copyRootfsData(g, contents)
+	if err := copyRootfsData(g, contents, diskLayout); err != nil {
+		log.Fatalf("Fail to import rootfs data %s\n", err)
+	}
+	customizeGuest(g, config, diskLayout)
 	createAdditionalSettings(g, diskLayout)
-	installBootloader(g, devices[0], "/boot")
+	writeCrypttab(g, device, diskLayout)
+	installVerityInitramfs(g, diskLayout)
+	installTargetSettings(g, target)
+	updateInitramfs(g, diskLayout, target.InitramfsModules)
+	generalizeGuest(g, config.Generalize)
+	if diskLayout.AB != nil {
+		installABBootloader(g, device, diskLayout, target.KernelCmdline)
+	} else {
+		installBootloader(g, devices[0], "/boot", diskLayout, target.KernelCmdline)
+	}
+	sealVerityRoot(g, diskLayout)
+	closeLuksContainers(g, diskLayout)
 
 	if err = g.Shutdown(); err != nil {
 		panic(fmt.Sprintf("write to disk failed: %s", err))
@@ -135,15 +171,17 @@ func partitionDiskAndCreateFs(g *guestfs.Guestfs, device string, layout *DiskLay
 			g.Part_set_gpt_type(device, p.ID, p.GptType)
 		}
 
+		//FIXME: get device from partition
+		partitionDevice := device + strconv.Itoa(p.ID)
+		if p.Encrypted != "" {
+			partitionDevice = createLuksContainer(g, partitionDevice, &p)
+		}
+
 		// create fs on partition (if it has one) with label
 		if p.Fstype != "" {
-			//FIXME: get device from partition
-			partitionDevice := device + strconv.Itoa(p.ID)
-			err := g.Mkfs(p.Fstype, partitionDevice, &guestfs.OptargsMkfs{
-				Label_is_set: true,
-				Label:        p.FsLabel})
+			err := createFilesystem(g, partitionDevice, p.Fstype, p.FsLabel, p.MkfsOptions, p.Subvolumes)
 			if err != nil {
-				log.Fatalf("Fail to create fs %s on device %s\n", p.Fstype, device)
+				log.Fatalf("Fail to create fs %s on device %s: %s\n", p.Fstype, partitionDevice, err)
 			}
 		}
 	}
@@ -158,11 +196,204 @@ func partitionDiskAndCreateFs(g *guestfs.Guestfs, device string, layout *DiskLay
 	}
 }
 
+// create filesystem fstype with label on device, tuned with opts, and its
+// btrfs subvolumes
+func createFilesystem(g *guestfs.Guestfs, device, fstype, label string, opts *MkfsOptions, subvolumes []Subvolume) error {
+	if opts == nil {
+		opts = &MkfsOptions{}
+	}
+
+	if opts.InodeRatio != 0 {
+		// only mke2fs can set the bytes per inode
+		err := g.Mke2fs(device, &guestfs.OptargsMke2fs{
+			Fstype_is_set:        true,
+			Fstype:               fstype,
+			Label_is_set:         true,
+			Label:                label,
+			Blocksize_is_set:     opts.BlockSize != 0,
+			Blocksize:            int64(opts.BlockSize),
+			Bytesperinode_is_set: true,
+			Bytesperinode:        opts.InodeRatio})
+		if err != nil {
+			return fmt.Errorf("%s", err.Errmsg)
+		}
+	} else {
+		err := g.Mkfs(fstype, device, &guestfs.OptargsMkfs{
+			Label_is_set:     true,
+			Label:            label,
+			Blocksize_is_set: opts.BlockSize != 0,
+			Blocksize:        opts.BlockSize,
+			Features_is_set:  opts.Features != "",
+			Features:         opts.Features})
+		if err != nil {
+			return fmt.Errorf("%s", err.Errmsg)
+		}
+	}
+
+	if opts.ReservedBlocks != nil {
+		err := g.Tune2fs(device, &guestfs.OptargsTune2fs{
+			Reservedblockspercentage_is_set: true,
+			Reservedblockspercentage:        *opts.ReservedBlocks})
+		if err != nil {
+			return fmt.Errorf("%s", err.Errmsg)
+		}
+	}
+
+	if len(subvolumes) == 0 {
+		return nil
+	}
+
+	// subvolumes are created from the top level volume, nothing else is
+	// mounted yet so use the root of the appliance
+	if err := g.Mount(device, "/"); err != nil {
+		return fmt.Errorf("%s", err.Errmsg)
+	}
+	for _, sv := range subvolumes {
+		if err := g.Btrfs_subvolume_create("/"+sv.Name, nil); err != nil {
+			return fmt.Errorf("%s", err.Errmsg)
+		}
+		log.Printf("[Info]   Create btrfs subvolume %s on %s\n", sv.Name, device)
+	}
+	if err := g.Umount(device, nil); err != nil {
+		return fmt.Errorf("%s", err.Errmsg)
+	}
+
+	return nil
+}
+
+// format the partition as a LUKS container and open it, return the device of
+// the opened container. luks_format use the default LUKS version of the
+// cryptsetup in the libguestfs appliance, which is luks2 since cryptsetup 2.1.
+// size of the magic and version of the LUKS header
+const luksHeaderSize = 8
+
+// luksHeaderVersion return the version of the LUKS header, 0 if it is not one
+func luksHeaderVersion(header []byte) int {
+	if len(header) < luksHeaderSize || !bytes.Equal(header[:6], []byte("LUKS\xba\xbe")) {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(header[6:8]))
+}
+
+func createLuksContainer(g *guestfs.Guestfs, partitionDevice string, p *Partition) string {
+	key, err := p.luksKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := g.Luks_format(partitionDevice, key, 0); err != nil {
+		log.Fatalf("Fail to create LUKS container on %s: %s\n", partitionDevice, err.Errmsg)
+	}
+	// luks_format uses the default of the cryptsetup of the appliance
+	header, gerr := g.Pread_device(partitionDevice, luksHeaderSize, 0)
+	if gerr != nil {
+		log.Fatalf("Fail to read LUKS header of %s: %s\n", partitionDevice, gerr.Errmsg)
+	}
+	if v := luksHeaderVersion(header); v != 2 {
+		log.Fatalf("LUKS container on %s is version %d, not LUKS2, the cryptsetup of libguestfs is too old\n", partitionDevice, v)
+	}
+	if err := g.Luks_open(partitionDevice, key, p.luksName()); err != nil {
+		log.Fatalf("Fail to open LUKS container on %s: %s\n", partitionDevice, err.Errmsg)
+	}
+	log.Printf("[Info] Create LUKS container %s on %s\n", p.luksName(), partitionDevice)
+
+	return "/dev/mapper/" + p.luksName()
+}
+
+// close the LUKS containers so everything is flushed before shutdown
+func closeLuksContainers(g *guestfs.Guestfs, layout *DiskLayout) {
+	if !layout.hasEncryptedPartitions() {
+		return
+	}
+
+	if err := g.Umount_all(); err != nil {
+		log.Fatalf("Fail to umount filesystems %s\n", err.Errmsg)
+	}
+	// volume groups on top of the containers keep them busy
+	if len(layout.VolumeGroups) != 0 {
+		if err := g.Vg_activate_all(false); err != nil {
+			log.Fatalf("Fail to deactivate volume groups %s\n", err.Errmsg)
+		}
+	}
+	for _, p := range layout.Partitions {
+		if p.Encrypted != "" {
+			if err := g.Luks_close("/dev/mapper/" + p.luksName()); err != nil {
+				log.Fatalf("Fail to close LUKS container %s\n", err.Errmsg)
+			}
+		}
+	}
+}
+
+// create lvm physical volumes, volume groups and logical volumes with filesystems
+func createVolumeGroups(g *guestfs.Guestfs, device string, layout *DiskLayout) {
+	if len(layout.VolumeGroups) == 0 {
+		return
+	}
+
+	partitions := map[string]Partition{}
+	for _, p := range layout.Partitions {
+		partitions[p.Name] = p
+	}
+
+	for _, vg := range layout.VolumeGroups {
+		var pvs []string
+		for _, pv := range vg.PhysicalVolumes {
+			//FIXME: get device from partition
+			pvDevice := device + strconv.Itoa(partitions[pv].ID)
+			if p := partitions[pv]; p.Encrypted != "" {
+				pvDevice = "/dev/mapper/" + p.luksName()
+			}
+			if err := g.Pvcreate(pvDevice); err != nil {
+				log.Fatalf("Fail to create physical volume on %s: %s\n", pvDevice, err.Errmsg)
+			}
+			pvs = append(pvs, pvDevice)
+		}
+
+		if err := g.Vgcreate(vg.Name, pvs); err != nil {
+			log.Fatalf("Fail to create volume group %s: %s\n", vg.Name, err.Errmsg)
+		}
+		log.Printf("[Info] Create volume group %s on %v\n", vg.Name, pvs)
+
+		// create the fixed size volumes first so the one using the rest of the
+		// space know what is left
+		lvs := append([]LogicalVolume{}, vg.LogicalVolumes...)
+		sort.SliceStable(lvs, func(i, j int) bool { return lvs[j].Size == LVSizeRest && lvs[i].Size != LVSizeRest })
+		for _, lv := range lvs {
+			if lv.Size == LVSizeRest {
+				if err := g.Lvcreate_free(lv.Name, vg.Name, 100); err != nil {
+					log.Fatalf("Fail to create logical volume %s: %s\n", lv.Name, err.Errmsg)
+				}
+			} else {
+				mb, err := lv.sizeMB()
+				if err != nil {
+					log.Fatal(err)
+				}
+				if err := g.Lvcreate(lv.Name, vg.Name, mb); err != nil {
+					log.Fatalf("Fail to create logical volume %s: %s\n", lv.Name, err.Errmsg)
+				}
+			}
+
+			if lv.Fstype != "" {
+				err := createFilesystem(g, lv.device(vg.Name), lv.Fstype, lv.FsLabel, lv.MkfsOptions, lv.Subvolumes)
+				if err != nil {
+					log.Fatalf("Fail to create fs %s on logical volume %s: %s\n", lv.Fstype, lv.device(vg.Name), err)
+				}
+			}
+			log.Printf("[Info]   Create logical volume %s size %s\n", lv.device(vg.Name), lv.Size)
+		}
+	}
+}
+
+// kernel cmdline for the serial and vga console
+const defaultKernelCmdline = "console=tty0 console=ttyS0,115200 no_timer_check nofb nomodeset vga=normal"
+
 // grub-install is not a questfs command
 // it is the command installed in the quest os - hence it is a command
 // TODO: check if grub-install exsits in the image first
 // https://wiki.archlinux.org/title/GRUB#UEFI_systems
-func installBootloader(g *guestfs.Guestfs, device string, bootDir string) {
+// installBootloader install grub booting the kernel with cmdline, and the
+// parameters needed by the disk layout
+func installBootloader(g *guestfs.Guestfs, device string, bootDir string, diskLayout *DiskLayout, cmdline string) {
 	// TODO:
 	// 1. ensure grub package is installed
 	// 2. ensure /boot partition is mounted (for efi)
@@ -184,10 +415,11 @@ func installBootloader(g *guestfs.Guestfs, device string, bootDir string) {
 	const grubSettingData = `GRUB_TIMEOUT=5
 GRUB_TERMINAL="serial console"
 GRUB_GFXPAYLOAD_LINUX=text
-GRUB_CMDLINE_LINUX_DEFAULT="console=tty0 console=ttyS0,115200 no_timer_check nofb nomodeset vga=normal"
+GRUB_CMDLINE_LINUX_DEFAULT="%s"
+GRUB_CMDLINE_LINUX="%s"
 GRUB_SERIAL_COMMAND="serial --speed=115200 --unit=0 --word=8 --parity=no --stop=1"
 `
-	err := g.Write(grubSetting, []byte(grubSettingData))
+	err := g.Write(grubSetting, []byte(fmt.Sprintf(grubSettingData, cmdline, diskLayout.kernelCmdline())))
 	if err != nil {
 		panic(err)
 	}
@@ -196,57 +428,65 @@ GRUB_SERIAL_COMMAND="serial --speed=115200 --unit=0 --word=8 --parity=no --stop=
 	grubOri := grubCfg + ".ori"
 	g.Command([]string{"cp", grubCfg, grubOri})
 
-	g.Command([]string{"sed", "-i", "s%root=/dev/sd[a-z][0-9]%root=LABEL=ROOT%", grubCfg})
-	g.Command([]string{"sed", "-i", "s%root='hd[0-9],gpt[0-9]'%root=LABEL=ROOT%", grubCfg})
-	g.Command([]string{"sed", "-i", "s%root=UUID=[A-Za-z0-9\\\\-]*%root=LABEL=ROOT%", grubCfg})
-	g.Command([]string{"sed", "-i", "s%search --no-floppy --fs-uuid --set=root .*$%search --no-floppy --set=root --label BOOT%", grubCfg})
+	root := diskLayout.rootDevice()
+	g.Command([]string{"sed", "-i", "s%root=/dev/sd[a-z][0-9]%root=" + root + "%", grubCfg})
+	g.Command([]string{"sed", "-i", "s%root='hd[0-9],gpt[0-9]'%root=" + root + "%", grubCfg})
+	g.Command([]string{"sed", "-i", "s%root=UUID=[A-Za-z0-9\\\\-]*%root=" + root + "%", grubCfg})
+	g.Command([]string{"sed", "-i", "s%search --no-floppy --fs-uuid --set=root .*$%search --no-floppy --set=root --label " + diskLayout.labelOf(bootDir) + "%", grubCfg})
 
 	log.Println("[Info] Install bootloader DONE")
 }
 
 func setupRootfs(g *guestfs.Guestfs, device string, diskLayout *DiskLayout) {
 	log.Println("[Info] Rootfs setup start....")
-	partitions := diskLayout.Partitions
-	// make sure root mount first
-	sort.Slice(partitions, func(i, j int) bool { return partitions[i].MountPoint < partitions[j].MountPoint })
+	// mountables are sorted by mount point so root is mounted first
+	for _, m := range diskLayout.mountables() {
+		mountFilesystem(g, m)
+	}
+	log.Println("[Info] Rootfs setup done")
 
-	for _, p := range diskLayout.Partitions {
-		if p.MountPoint != "" {
-			partitionDevice, err := getPartitionDeviceByName(g, p.Name)
-			if err != nil {
-				log.Fatal(err)
-			}
+}
 
-			if p.MountPoint != "/" {
-				if err := g.Mkdir_p(p.MountPoint); err != nil {
-					log.Fatalln(err.Errmsg)
-				}
+// mountAt mount only the filesystem of the layout mounted at mountPoint
+func mountAt(g *guestfs.Guestfs, diskLayout *DiskLayout, mountPoint string) {
+	for _, m := range diskLayout.mountables() {
+		if m.MountPoint == mountPoint {
+			mountFilesystem(g, m)
+		}
+	}
+}
 
-			}
-			if err := g.Mount(partitionDevice, p.MountPoint); err != nil {
-				log.Fatalln(err.Errmsg)
-			}
-			log.Printf("[Info]   Mount %s at %s OK\n", p.MountPoint, partitionDevice)
+func mountFilesystem(g *guestfs.Guestfs, m mountable) {
+	mountDevice := m.Device
+	if m.Partition != "" {
+		partitionDevice, err := getPartitionDeviceByName(g, m.Partition)
+		if err != nil {
+			log.Fatal(err)
 		}
+		mountDevice = partitionDevice
 	}
-	log.Println("[Info] Rootfs setup done")
 
+	if m.MountPoint != "/" {
+		if err := g.Mkdir_p(m.MountPoint); err != nil {
+			log.Fatalln(err.Errmsg)
+		}
+
+	}
+	if m.Options != "" {
+		if err := g.Mount_options(m.Options, mountDevice, m.MountPoint); err != nil {
+			log.Fatalln(err.Errmsg)
+		}
+	} else if err := g.Mount(mountDevice, m.MountPoint); err != nil {
+		log.Fatalln(err.Errmsg)
+	}
+	log.Printf("[Info]   Mount %s at %s OK\n", m.MountPoint, mountDevice)
 }
 
 // 1. set up fstab - call this after copyRootfsData
 // 2. "fix" the side-effect caused by docker create container
 func createAdditionalSettings(g *guestfs.Guestfs, diskLayout *DiskLayout) {
 	// 1. set up fstab using diskLayout
-	var fstabEntries []string
-	for _, p := range diskLayout.Partitions {
-		// we don't mount boot partition, systemd is taking care of
-		if p.MountPoint != "" && p.Fstype != "" && p.FsLabel != "BOOT" {
-			entry := fmt.Sprintf("LABEL=%s %s %s %s 0 0", p.FsLabel, p.MountPoint, p.Fstype, p.FsMountOps)
-			fstabEntries = append(fstabEntries, entry)
-		}
-	}
-
-	fstabContent := strings.Join(fstabEntries, "\n")
+	fstabContent := diskLayout.fstab()
 	log.Printf("/etc/fstab %s\n", fstabContent)
 	g.Write_append("/etc/fstab", []byte(fstabContent))
 
@@ -257,27 +497,185 @@ func createAdditionalSettings(g *guestfs.Guestfs, diskLayout *DiskLayout) {
 	g.Rm_f("/.dockerenv")
 }
 
-func copyRootfsData(g *guestfs.Guestfs, contents *[]Content) error {
+// write /etc/crypttab and install the keys of the encrypted partitions
+func writeCrypttab(g *guestfs.Guestfs, device string, diskLayout *DiskLayout) {
+	if !diskLayout.hasEncryptedPartitions() {
+		return
+	}
+
+	uuids := map[string]string{}
+	for i := range diskLayout.Partitions {
+		p := &diskLayout.Partitions[i]
+		if p.Encrypted == "" {
+			continue
+		}
+
+		//FIXME: get device from partition
+		partitionDevice := device + strconv.Itoa(p.ID)
+		uuid, err := g.Vfs_uuid(partitionDevice)
+		if err != nil {
+			log.Fatalf("Fail to get LUKS uuid of %s: %s\n", partitionDevice, err.Errmsg)
+		}
+		uuids[p.Name] = uuid
+
+		if p.KeyFile != "" && !diskLayout.holdsRoot(p) {
+			key, err := p.luksKey()
+			if err != nil {
+				log.Fatal(err)
+			}
+			keyFile := luksKeyFile(p)
+			if err := g.Mkdir_p(path.Dir(keyFile)); err != nil {
+				log.Fatalln(err.Errmsg)
+			}
+			if err := g.Write(keyFile, []byte(key)); err != nil {
+				log.Fatalln(err.Errmsg)
+			}
+			if err := g.Chmod(0400, keyFile); err != nil {
+				log.Fatalln(err.Errmsg)
+			}
+		}
+	}
+
+	crypttab := diskLayout.crypttab(uuids)
+	log.Printf("/etc/crypttab %s\n", crypttab)
+	if err := g.Write("/etc/crypttab", []byte(crypttab+"\n")); err != nil {
+		log.Fatalln(err.Errmsg)
+	}
+}
+
+// make sure the tools the layout needs at boot are in the image and
+// regenerate the initramfs so that they and the modules are included
+func updateInitramfs(g *guestfs.Guestfs, diskLayout *DiskLayout, modules []string) {
+	tools := diskLayout.requiredGuestTools()
+	if len(tools) == 0 && len(modules) == 0 {
+		return
+	}
+
+	for _, t := range tools {
+		if _, err := g.Sh("command -v " + t.Binary); err != nil {
+			log.Fatalf("%s is required by the disk layout but not found in the image, install package %s\n", t.Binary, t.Package)
+		}
+	}
+
+	log.Println("[Info] Update initramfs")
+	if out, err := g.Command([]string{"update-initramfs", "-u", "-k", "all"}); err != nil {
+		log.Fatalf("Fail to update initramfs %s %s\n", out, err.Errmsg)
+	}
+}
+
+func copyRootfsData(g *guestfs.Guestfs, contents *[]Content, diskLayout *DiskLayout) error {
 	log.Println("[Info] Import rootfs data")
 	cs := *contents
 	// content are copied as in the same sequences they should be mounted
-	// e.g / first, then /boot
-	sort.Slice(cs, func(i, j int) bool { return cs[i].destDir < cs[j].destDir })
+	// e.g / first, then /boot, then the partitions not mounted in the rootfs.
+	// Copied files and directories go on top of everything else.
+	sort.SliceStable(cs, func(i, j int) bool {
+		ci, cj := cs[i].sourceType == ContentTypeCopy, cs[j].sourceType == ContentTypeCopy
+		if ci != cj {
+			return cj
+		}
+		if cs[i].partition != cs[j].partition {
+			return cs[i].partition < cs[j].partition
+		}
+		return cs[i].destDir < cs[j].destDir
+	})
 	for _, c := range cs {
-		if c.sourceType == "tar" {
-			tarInOpt := guestfs.OptargsTar_in{
-				Xattrs_is_set: true,
-				Xattrs:        false,
-				Acls_is_set:   true,
-				Acls:          false,
-			}
-			if err := g.Tar_in(c.source, c.destDir, &tarInOpt); err != nil {
-				return fmt.Errorf("%s", err.Errmsg)
-			}
-			log.Printf("[Info]   Import %s(%s) %s\n", c.source, c.sourceType, c.destDir)
+		if err := importContent(g, c, diskLayout); err != nil {
+			return err
 		}
 	}
 	log.Println("[Info] Import rootfs data DONE")
 
 	return nil
 }
+
+func importContent(g *guestfs.Guestfs, c Content, diskLayout *DiskLayout) error {
+	destDir := c.destDir
+	if c.partition != "" {
+		mountPoint, umount, err := mountContentPartition(g, c.partition, diskLayout)
+		if err != nil {
+			return err
+		}
+		defer umount()
+		destDir = path.Join(mountPoint, c.destDir)
+	}
+
+	source := c.source
+	switch c.sourceType {
+	case ContentTypeCopy:
+		return copyInHostPath(g, c)
+	case ContentTypeTar:
+	case ContentTypeDir:
+		tarFile, err := tarHostDir(c.source)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tarFile)
+		source = tarFile
+	default:
+		return fmt.Errorf("unsupported content type %s for %s", c.sourceType, c.source)
+	}
+
+	if err := g.Mkdir_p(destDir); err != nil {
+		return fmt.Errorf("%s", err.Errmsg)
+	}
+
+	tarInOpt := guestfs.OptargsTar_in{
+		Xattrs_is_set: true,
+		Xattrs:        false,
+		Acls_is_set:   true,
+		Acls:          false,
+	}
+	if err := g.Tar_in(source, destDir, &tarInOpt); err != nil {
+		return fmt.Errorf("%s", err.Errmsg)
+	}
+	log.Printf("[Info]   Import %s(%s) %s\n", c.source, c.sourceType, destDir)
+	return nil
+}
+
+// mount the partition to copy content to, return where it is mounted and a
+// function to umount it. A partition mounted in the rootfs is used as it is.
+func mountContentPartition(g *guestfs.Guestfs, name string, diskLayout *DiskLayout) (string, func(), error) {
+	for _, m := range diskLayout.mountables() {
+		if m.Partition == name {
+			return m.MountPoint, func() {}, nil
+		}
+	}
+
+	var partition *Partition
+	for i := range diskLayout.Partitions {
+		if diskLayout.Partitions[i].Name == name {
+			partition = &diskLayout.Partitions[i]
+		}
+	}
+	if partition == nil || partition.Fstype == "" || len(partition.Subvolumes) != 0 {
+		return "", nil, fmt.Errorf("can not copy content to partition %s, it should have a filesystem", name)
+	}
+
+	device, err := getPartitionDeviceByName(g, name)
+	if err != nil {
+		return "", nil, err
+	}
+	if partition.Encrypted != "" {
+		device = "/dev/mapper/" + partition.luksName()
+	}
+
+	// mounted temporarily in the rootfs, nothing is left once umounted
+	mountPoint := "/.d2b-" + name
+	if err := g.Mkdir_p(mountPoint); err != nil {
+		return "", nil, fmt.Errorf("%s", err.Errmsg)
+	}
+	if err := g.Mount(device, mountPoint); err != nil {
+		return "", nil, fmt.Errorf("%s", err.Errmsg)
+	}
+
+	umount := func() {
+		if err := g.Umount(mountPoint, nil); err != nil {
+			log.Fatalf("Fail to umount %s %s\n", mountPoint, err.Errmsg)
+		}
+		if err := g.Rmdir(mountPoint); err != nil {
+			log.Fatalf("Fail to remove %s %s\n", mountPoint, err.Errmsg)
+		}
+	}
+	return mountPoint, umount, nil
+}
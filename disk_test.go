@@ -65,3 +65,15 @@ func TestSortMount(t *testing.T) {
 		}
 	}
 }
+
+func TestLuksHeaderVersion(t *testing.T) {
+	if v := luksHeaderVersion([]byte("LUKS\xba\xbe\x00\x02")); v != 2 {
+		t.Errorf("version %d, want 2", v)
+	}
+	if v := luksHeaderVersion([]byte("LUKS\xba\xbe\x00\x01")); v != 1 {
+		t.Errorf("version %d, want 1", v)
+	}
+	if v := luksHeaderVersion(make([]byte, 8)); v != 0 {
+		t.Errorf("version %d of a non LUKS header", v)
+	}
+}
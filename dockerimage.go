@@ -3,11 +3,9 @@ package main
 import (
 	"context"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
-	"path"
-	"strconv"
-	"time"
 
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
@@ -15,12 +13,13 @@ import (
 
 // UnpackDockerimage unpack docker image to a tar file
 func UnpackDockerImage(image string) (string, error) {
-	// create temp tar file to unpack
-	outFile := path.Join(os.TempDir(), "d2b"+strconv.Itoa(int(time.Now().Unix()))+".tar")
-	outf, err := os.Create(outFile)
+	// create temp tar file to unpack, several images can be unpacked for one disk
+	outf, err := ioutil.TempFile(os.TempDir(), "d2b*.tar")
 	if err != nil {
-		log.Fatalf("Failed to create file %s %s", outFile, err)
+		log.Fatalf("Failed to create file to unpack %s %s", image, err)
 	}
+	defer outf.Close()
+	outFile := outf.Name()
 
 	ctx := context.Background()
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// files of the config are created in the tree of the build context and copied
+// to the image with COPY tree/ /. The owners are set and the contents
+// appended by a RUN after the copy, see fileCommands.
+
+const (
+	FileTypeFile    = "file"
+	FileTypeDir     = "dir"
+	FileTypeSymlink = "symlink"
+)
+
+const (
+	FileEncodingBase64     = "base64"
+	FileEncodingGzipBase64 = "gzip+base64"
+)
+
+// the contents appended are copied with the tree to this directory, removed
+// once appended
+const fileAppendDir = "/.d2b-append"
+
+// configTemplateFuncs are the functions of the templates executed with the
+// config, the Dockerfile and the files
+var configTemplateFuncs = template.FuncMap{
+	"join": strings.Join,
+	"env":  os.Getenv,
+}
+
+var fileOwnerRe = regexp.MustCompile(`^([a-z_][a-z0-9_-]*\$?|[0-9]+)$`)
+
+func (f *File) fileType() string {
+	if f.Type == "" {
+		return FileTypeFile
+	}
+	return f.Type
+}
+
+// validate the file without reading its source
+func (f *File) validate() error {
+	for _, name := range []string{f.Owner, f.Group} {
+		if name != "" && !fileOwnerRe.MatchString(name) {
+			return fmt.Errorf("invalid owner or group %q", name)
+		}
+	}
+	hasContent := f.Content != "" || f.Source != "" || f.Encoding != "" || f.Template || f.Append
+	switch f.fileType() {
+	case FileTypeFile:
+		if f.Content != "" && f.Source != "" {
+			return fmt.Errorf("should have either content or source")
+		}
+		if f.Target != "" {
+			return fmt.Errorf("target is only for a symlink")
+		}
+		if f.Encoding != "" && f.Source != "" {
+			return fmt.Errorf("encoding is only for content, source is copied as is")
+		}
+		if _, err := f.decodeContent(); err != nil {
+			return err
+		}
+	case FileTypeDir:
+		if hasContent || f.Target != "" {
+			return fmt.Errorf("a dir has no content, source nor target")
+		}
+	case FileTypeSymlink:
+		if f.Target == "" {
+			return fmt.Errorf("a symlink needs a target")
+		}
+		if hasContent || f.Mode != "" {
+			return fmt.Errorf("a symlink has no content, source nor mode")
+		}
+	default:
+		return fmt.Errorf("unknown type %s, should be file, dir or symlink", f.Type)
+	}
+	return nil
+}
+
+func (f *File) decodeContent() ([]byte, error) {
+	// encoded content can be split on lines
+	encoded := strings.Join(strings.Fields(f.Content), "")
+	switch f.Encoding {
+	case "":
+		return []byte(f.Content), nil
+	case FileEncodingBase64:
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 content %s", err)
+		}
+		return data, nil
+	case FileEncodingGzipBase64:
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 content %s", err)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip content %s", err)
+		}
+		defer zr.Close()
+		if data, err = ioutil.ReadAll(zr); err != nil {
+			return nil, fmt.Errorf("invalid gzip content %s", err)
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("unknown encoding %s, should be base64 or gzip+base64", f.Encoding)
+}
+
+// data return the content of the file in the image, the template is
+// executed with c
+func (f *File) data(c *Config) ([]byte, error) {
+	var data []byte
+	var err error
+	if f.Source != "" {
+		data, err = ioutil.ReadFile(f.Source)
+	} else {
+		data, err = f.decodeContent()
+	}
+	if err != nil || !f.Template {
+		return data, err
+	}
+
+	tmpl, err := template.New(f.Path).Funcs(configTemplateFuncs).Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, *c); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (f *File) mode() (os.FileMode, error) {
+	if f.Mode == "" {
+		if f.fileType() == FileTypeDir {
+			return 0755, nil
+		}
+		return 0644, nil
+	}
+	perm, err := strconv.ParseUint(f.Mode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid mode %s", f.Mode)
+	}
+	return os.FileMode(perm), nil
+}
+
+// appendPath is where the content of the i-th file is copied to be appended
+func (f *File) appendPath(i int) string {
+	return path.Join(fileAppendDir, strconv.Itoa(i))
+}
+
+// writeTree create the i-th file of c in tree
+func (f *File) writeTree(tree string, i int, c *Config) error {
+	target := path.Join(tree, f.Path)
+	switch f.fileType() {
+	case FileTypeSymlink:
+		if err := os.MkdirAll(path.Dir(target), 0775); err != nil {
+			return err
+		}
+		return os.Symlink(f.Target, target)
+	case FileTypeDir:
+		mode, err := f.mode()
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(target, mode); err != nil {
+			return err
+		}
+		// not masked by the umask
+		return os.Chmod(target, mode)
+	}
+
+	data, err := f.data(c)
+	if err != nil {
+		return err
+	}
+	mode, err := f.mode()
+	if err != nil {
+		return err
+	}
+	if f.Append {
+		target = path.Join(tree, f.appendPath(i))
+	}
+	// dir need the x bits for owner (a.k.a need the 7) so that owner can read the conents
+	// so 775 is the correct permission for directoryies
+	if err := os.MkdirAll(path.Dir(target), 0775); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(target, data, mode); err != nil {
+		return err
+	}
+	return os.Chmod(target, mode)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// fileCommands return the commands run after the tree is copied, appending
+// the contents and setting the owners
+func fileCommands(files []File) []string {
+	var cmds []string
+	appended := false
+	for i, f := range files {
+		file := shellQuote(f.Path)
+		if f.Append {
+			cmds = append(cmds,
+				"mkdir -p "+shellQuote(path.Dir(f.Path)),
+				"cat "+f.appendPath(i)+" >> "+file)
+			if f.Mode != "" {
+				cmds = append(cmds, "chmod "+f.Mode+" "+file)
+			}
+			appended = true
+		}
+		if f.Owner != "" || f.Group != "" {
+			owner := f.Owner
+			if f.Group != "" {
+				owner += ":" + f.Group
+			}
+			if f.fileType() == FileTypeSymlink {
+				cmds = append(cmds, "chown -h "+owner+" "+file)
+			} else {
+				cmds = append(cmds, "chown "+owner+" "+file)
+			}
+		}
+	}
+	if appended {
+		cmds = append(cmds, "rm -rf "+fileAppendDir)
+	}
+	return cmds
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileValidate(t *testing.T) {
+	valid := []File{
+		{Path: "/etc/motd", Content: "hello"},
+		{Path: "/etc/motd", Source: "motd", Owner: "www-data", Group: "1000"},
+		{Path: "/opt/app", Type: FileTypeDir, Mode: "0750", Owner: "app"},
+		{Path: "/etc/localtime", Type: FileTypeSymlink, Target: "/usr/share/zoneinfo/UTC"},
+		{Path: "/bin/tool", Content: "aGk=", Encoding: FileEncodingBase64},
+	}
+	for _, f := range valid {
+		if err := f.validate(); err != nil {
+			t.Errorf("%#v: %s", f, err)
+		}
+	}
+	invalid := []File{
+		{Path: "/etc/motd", Content: "a", Source: "b"},
+		{Path: "/etc/motd", Owner: "Bad Name"},
+		{Path: "/opt/app", Type: FileTypeDir, Content: "a"},
+		{Path: "/etc/localtime", Type: FileTypeSymlink},
+		{Path: "/etc/localtime", Type: FileTypeSymlink, Target: "/a", Mode: "0644"},
+		{Path: "/bin/tool", Content: "not base64!", Encoding: FileEncodingBase64},
+		{Path: "/bin/tool", Content: "a", Encoding: "rot13"},
+		{Path: "/dev/x", Type: "fifo"},
+	}
+	for _, f := range invalid {
+		if err := f.validate(); err == nil {
+			t.Errorf("%#v should be invalid", f)
+		}
+	}
+}
+
+func TestFileData(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte{0, 1, 2, 0xff})
+	zw.Close()
+	encoded := base64.StdEncoding.EncodeToString(gz.Bytes())
+
+	c := &Config{Login: "root:root", Packages: []string{"curl", "vim"}}
+	f := File{Path: "/bin/blob", Content: encoded[:8] + "\n" + encoded[8:], Encoding: FileEncodingGzipBase64}
+	if data, err := f.data(c); err != nil || !bytes.Equal(data, []byte{0, 1, 2, 0xff}) {
+		t.Errorf("gzip content %v %v", data, err)
+	}
+
+	os.Setenv("D2B_TEST_REGION", "eu")
+	defer os.Unsetenv("D2B_TEST_REGION")
+	f = File{Path: "/etc/app.conf", Content: "packages={{ join .Packages \",\" }} region={{ env \"D2B_TEST_REGION\" }}\n", Template: true}
+	if data, err := f.data(c); err != nil || string(data) != "packages=curl,vim region=eu\n" {
+		t.Errorf("template content %q %v", data, err)
+	}
+	f.Content = "{{ .NoSuchField }}"
+	if _, err := f.data(c); err == nil {
+		t.Errorf("an unknown field should fail")
+	}
+}
+
+func TestFilesTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "d2b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := filepath.Join(dir, "source")
+	if err := ioutil.WriteFile(source, []byte("from host"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Config{
+		Kernel:        "5.4.0-58",
+		UbuntuVersion: "20.04",
+		Files: []File{
+			{Path: "/etc/motd", Source: source, Mode: "0664"},
+			{Path: "/opt/app", Type: FileTypeDir, Mode: "0750", Owner: "app", Group: "app"},
+			{Path: "/etc/localtime", Type: FileTypeSymlink, Target: "/usr/share/zoneinfo/UTC", Owner: "root"},
+			{Path: "/etc/hosts", Content: "10.0.0.1 app\n", Append: true, Mode: "0644"},
+		},
+	}
+	if err := c.validateImage(); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out")
+	if err := renderBuildContext(c, out); err != nil {
+		t.Fatal(err)
+	}
+	tree := filepath.Join(out, "tree")
+
+	if data, err := ioutil.ReadFile(filepath.Join(tree, "etc/motd")); err != nil || string(data) != "from host" {
+		t.Errorf("source not copied %s %v", data, err)
+	}
+	if info, err := os.Stat(filepath.Join(tree, "etc/motd")); err != nil || info.Mode().Perm() != 0664 {
+		t.Errorf("etc/motd should be 0664 %v %v", info, err)
+	}
+	if info, err := os.Stat(filepath.Join(tree, "opt/app")); err != nil || !info.IsDir() || info.Mode().Perm() != 0750 {
+		t.Errorf("opt/app should be a 0750 dir %v %v", info, err)
+	}
+	if target, err := os.Readlink(filepath.Join(tree, "etc/localtime")); err != nil || target != "/usr/share/zoneinfo/UTC" {
+		t.Errorf("etc/localtime should be a symlink %s %v", target, err)
+	}
+	if _, err := os.Stat(filepath.Join(tree, "etc/hosts")); err == nil {
+		t.Errorf("an appended file should not replace the file")
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(tree, fileAppendDir, "3")); err != nil || string(data) != "10.0.0.1 app\n" {
+		t.Errorf("appended content %s %v", data, err)
+	}
+
+	dockerfile, err := ioutil.ReadFile(filepath.Join(out, "Dockerfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `COPY tree/ /
+RUN chown app:app '/opt/app' \
+    && chown -h root '/etc/localtime' \
+    && mkdir -p '/etc' \
+    && cat /.d2b-append/3 >> '/etc/hosts' \
+    && chmod 0644 '/etc/hosts' \
+    && rm -rf /.d2b-append
+`
+	if !strings.Contains(string(dockerfile), want) {
+		t.Errorf("dockerfile %s should contain %s", dockerfile, want)
+	}
+}
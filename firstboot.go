@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"text/template"
+
+	"github.com/binchenx/guestfs"
+)
+
+// first boot scripts
+//
+// Each script is run once by its own oneshot unit, which creates a done file
+// when the script succeeds. The unit is skipped once the done file exists and
+// retried at the next boot if the script fails.
+
+const (
+	firstbootScriptDir = "/usr/lib/d2b/firstboot"
+	firstbootDoneDir   = "/var/lib/d2b/firstboot"
+	firstbootUnitDir   = "/etc/systemd/system"
+)
+
+var firstbootNameRe = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// the units run before sysinit.target, which the unit is ordered after by its
+// default dependencies, a script run before them would be an ordering cycle
+var firstbootEarlyUnits = map[string]bool{
+	"sysinit.target":             true,
+	"basic.target":               true,
+	"sockets.target":             true,
+	"paths.target":               true,
+	"timers.target":              true,
+	"swap.target":                true,
+	"cryptsetup.target":          true,
+	"local-fs-pre.target":        true,
+	"local-fs.target":            true,
+	"network-pre.target":         true,
+	"systemd-journald.service":   true,
+	"systemd-udevd.service":      true,
+	"systemd-remount-fs.service": true,
+	"cloud-init-local.service":   true,
+	"cloud-init.service":         true,
+}
+
+func (f *FirstbootScript) validate() error {
+	if !firstbootNameRe.MatchString(f.Name) {
+		return fmt.Errorf("firstboot: invalid name %q, use letters, digits, - and _", f.Name)
+	}
+	if (f.Script == "") == (f.Content == "") {
+		return fmt.Errorf("firstboot %s: should have either script or content", f.Name)
+	}
+	after := map[string]bool{}
+	for _, u := range f.After {
+		after[u] = true
+	}
+	for _, u := range f.Before {
+		if firstbootEarlyUnits[u] {
+			return fmt.Errorf("firstboot %s: cannot run before %s, it runs before sysinit.target", f.Name, u)
+		}
+		if after[u] {
+			return fmt.Errorf("firstboot %s: cannot run both before and after %s", f.Name, u)
+		}
+	}
+	return nil
+}
+
+func (f *FirstbootScript) unitName() string {
+	return "d2b-firstboot-" + f.Name + ".service"
+}
+
+func (f *FirstbootScript) scriptPath() string {
+	return path.Join(firstbootScriptDir, f.Name)
+}
+
+func (f *FirstbootScript) donePath() string {
+	return path.Join(firstbootDoneDir, f.Name+".done")
+}
+
+// units ordered after network-online.target also need to pull it in
+func (f *FirstbootScript) wants() []string {
+	for _, u := range f.After {
+		if u == "network-online.target" {
+			return []string{u}
+		}
+	}
+	return nil
+}
+
+var firstbootUnitTemplate = template.Must(template.New("unit").Parse(`[Unit]
+Description=First boot script {{ .Name }}
+ConditionPathExists=!{{ .Done }}
+{{- range .Wants }}
+Wants={{ . }}
+{{- end }}
+{{- range .After }}
+After={{ . }}
+{{- end }}
+{{- range .Before }}
+Before={{ . }}
+{{- end }}
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart={{ .Script }}
+ExecStartPost=/bin/mkdir -p ` + firstbootDoneDir + `
+ExecStartPost=/bin/touch {{ .Done }}
+StandardOutput=journal+console
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+// firstbootUnit return the systemd unit running the script
+func firstbootUnit(f *FirstbootScript) string {
+	var buf bytes.Buffer
+	data := map[string]interface{}{
+		"Name":   f.Name,
+		"Script": f.scriptPath(),
+		"Done":   f.donePath(),
+		"Wants":  f.wants(),
+		"After":  f.After,
+		"Before": f.Before,
+	}
+	if err := firstbootUnitTemplate.Execute(&buf, data); err != nil {
+		panic(err)
+	}
+	return buf.String()
+}
+
+// install and enable the first boot scripts
+func installFirstboot(g *guestfs.Guestfs, scripts []FirstbootScript) {
+	if len(scripts) == 0 {
+		return
+	}
+
+	wants := path.Join(firstbootUnitDir, "multi-user.target.wants")
+	for _, dir := range []string{firstbootScriptDir, wants} {
+		if err := g.Mkdir_p(dir); err != nil {
+			log.Fatalln(err.Errmsg)
+		}
+	}
+
+	for i := range scripts {
+		f := &scripts[i]
+		if err := f.validate(); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("[Info] Install first boot script %s\n", f.Name)
+
+		if f.Script != "" {
+			if err := g.Upload(f.Script, f.scriptPath()); err != nil {
+				log.Fatalf("Fail to copy %s: %s\n", f.Script, err.Errmsg)
+			}
+		} else {
+			if err := g.Write(f.scriptPath(), []byte(f.Content)); err != nil {
+				log.Fatalln(err.Errmsg)
+			}
+		}
+		if err := g.Chmod(0755, f.scriptPath()); err != nil {
+			log.Fatalln(err.Errmsg)
+		}
+
+		unit := path.Join(firstbootUnitDir, f.unitName())
+		if err := g.Write(unit, []byte(firstbootUnit(f))); err != nil {
+			log.Fatalln(err.Errmsg)
+		}
+		if err := g.Ln_sf(unit, path.Join(wants, f.unitName())); err != nil {
+			log.Fatalln(err.Errmsg)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFirstbootUnit(t *testing.T) {
+	f := FirstbootScript{
+		Name:    "register",
+		Content: "#!/bin/sh\ncurl -X POST http://inventory/register\n",
+		After:   []string{"network-online.target"},
+		Before:  []string{"getty.target"},
+	}
+	if err := f.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	unit := firstbootUnit(&f)
+	for _, line := range []string{
+		"ConditionPathExists=!/var/lib/d2b/firstboot/register.done",
+		"Wants=network-online.target",
+		"After=network-online.target",
+		"Before=getty.target",
+		"ExecStart=/usr/lib/d2b/firstboot/register",
+		"ExecStartPost=/bin/touch /var/lib/d2b/firstboot/register.done",
+	} {
+		if !strings.Contains(unit, line+"\n") {
+			t.Errorf("missing %s in\n%s", line, unit)
+		}
+	}
+
+	invalid := []FirstbootScript{
+		{Name: "register"},
+		{Name: "register", Script: "register.sh", Content: "true"},
+		{Name: "../register", Content: "true"},
+		{Name: "register", Content: "true", Before: []string{"cloud-init.service"}},
+		{Name: "register", Content: "true", After: []string{"ssh.service"}, Before: []string{"ssh.service"}},
+	}
+	for _, f := range invalid {
+		if err := f.validate(); err == nil {
+			t.Errorf("expected error for %#v", f)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/binchenx/guestfs"
+)
+
+// generalize remove what is specific to the built image so that the clones
+// are distinct machines, like virt-sysprep
+
+type generalizeOperation struct {
+	Name string
+	// Script is run by sh in the guest
+	Script string
+}
+
+var generalizeOperations = []generalizeOperation{
+	{
+		// an empty machine-id is generated at the first boot
+		Name: "machine-id",
+		Script: `truncate -s 0 /etc/machine-id
+[ -L /var/lib/dbus/machine-id ] || rm -f /var/lib/dbus/machine-id`,
+	},
+	{
+		// the keys are generated at the first boot, see sshHostKeysFirstboot
+		Name:   "ssh-hostkeys",
+		Script: `rm -f /etc/ssh/ssh_host_*_key /etc/ssh/ssh_host_*_key.pub`,
+	},
+	{
+		Name: "apt",
+		Script: `rm -rf /var/lib/apt/lists/*
+rm -f /var/cache/apt/*.bin /var/cache/apt/archives/*.deb /var/cache/apt/archives/partial/*`,
+	},
+	{
+		// the files are kept since some daemons don't create them
+		Name: "logs",
+		Script: `find /var/log -type f \( -name '*.gz' -o -name '*.[0-9]' -o -name '*.old' \) -delete
+find /var/log -type f -exec truncate -s 0 {} +
+rm -rf /var/log/journal/*`,
+	},
+	{
+		Name:   "histories",
+		Script: `rm -f /root/.*_history /home/*/.*_history`,
+	},
+	{
+		Name: "tmp",
+		Script: `[ ! -d /tmp ] || find /tmp -mindepth 1 -delete
+[ ! -d /var/tmp ] || find /var/tmp -mindepth 1 -delete`,
+	},
+	{
+		// the seed is kept
+		Name:   "cloud-init",
+		Script: `[ ! -d /var/lib/cloud ] || find /var/lib/cloud -mindepth 1 -maxdepth 1 ! -name seed -exec rm -rf {} +`,
+	},
+}
+
+// regenerate the ssh host keys removed by the ssh-hostkeys operation
+var sshHostKeysFirstboot = FirstbootScript{
+	Name:    "ssh-hostkeys",
+	Content: "#!/bin/sh\n[ ! -x /usr/bin/ssh-keygen ] || /usr/bin/ssh-keygen -A\n",
+	Before:  []string{"ssh.service"},
+}
+
+func (c *Generalize) validate() error {
+	if c == nil {
+		return nil
+	}
+	known := map[string]bool{}
+	for _, o := range generalizeOperations {
+		known[o.Name] = true
+	}
+	for _, name := range append(append([]string{}, c.Operations...), c.Skip...) {
+		if !known[name] {
+			return fmt.Errorf("generalize: unknown operation %s", name)
+		}
+	}
+	return nil
+}
+
+// operations return the operations to run, all of them by default
+func (c *Generalize) operations() []generalizeOperation {
+	if c == nil {
+		return generalizeOperations
+	}
+	if c.Disabled {
+		return nil
+	}
+
+	selected := map[string]bool{}
+	for _, name := range c.Operations {
+		selected[name] = true
+	}
+	for _, name := range c.Skip {
+		selected[name] = false
+	}
+
+	var ops []generalizeOperation
+	for _, o := range generalizeOperations {
+		if enabled, ok := selected[o.Name]; (ok && enabled) || (!ok && len(c.Operations) == 0) {
+			ops = append(ops, o)
+		}
+	}
+	return ops
+}
+
+func generalizeGuest(g *guestfs.Guestfs, c *Generalize) {
+	if err := c.validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	ops := c.operations()
+	if len(ops) == 0 {
+		return
+	}
+
+	log.Println("[Info] Generalize")
+	for _, o := range ops {
+		log.Printf("[Info]   %s\n", o.Name)
+		if out, err := guestSh(g, o.Script); err != nil {
+			log.Fatalf("Fail to generalize %s: %s %s\n", o.Name, out, err)
+		}
+		if o.Name == sshHostKeysFirstboot.Name {
+			installFirstboot(g, []FirstbootScript{sshHostKeysFirstboot})
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+)
+
+func operationNames(ops []generalizeOperation) []string {
+	var names []string
+	for _, o := range ops {
+		names = append(names, o.Name)
+	}
+	return names
+}
+
+func TestGeneralizeOperations(t *testing.T) {
+	var c *Generalize
+	if len(c.operations()) != len(generalizeOperations) {
+		t.Errorf("all operations should run by default")
+	}
+	if len((&Generalize{}).operations()) != len(generalizeOperations) {
+		t.Errorf("all operations should run for an empty generalize")
+	}
+
+	tests := []struct {
+		c        Generalize
+		expected []string
+	}{
+		{Generalize{Disabled: true}, nil},
+		{Generalize{Operations: []string{"tmp", "machine-id"}}, []string{"machine-id", "tmp"}},
+		{Generalize{Skip: []string{"apt", "logs", "histories", "tmp", "cloud-init"}}, []string{"machine-id", "ssh-hostkeys"}},
+		{Generalize{Operations: []string{"tmp", "logs"}, Skip: []string{"logs"}}, []string{"tmp"}},
+	}
+	for _, test := range tests {
+		if err := test.c.validate(); err != nil {
+			t.Fatal(err)
+		}
+		names := operationNames(test.c.operations())
+		if len(names) != len(test.expected) {
+			t.Errorf("expected %v got %v", test.expected, names)
+			continue
+		}
+		for i := range names {
+			if names[i] != test.expected[i] {
+				t.Errorf("expected %v got %v", test.expected, names)
+			}
+		}
+	}
+
+	c = &Generalize{Skip: []string{"ssh"}}
+	if err := c.validate(); err == nil {
+		t.Errorf("expected error for unknown operation")
+	}
+}
@@ -10,7 +10,6 @@ import (
 	"log"
 	"os"
 	"path"
-	"strconv"
 	"strings"
 	"text/template"
 
@@ -19,26 +18,36 @@ import (
 	"github.com/docker/docker/pkg/archive"
 )
 
-// base dockerfile and we'll add package on top of it
-var base = `FROM ubuntu:{{.UbuntuVersion}} AS ubuntu
+// base dockerfile and we'll add package on top of it, the config starts from
+// ubuntu with the kernel, or is layered on the image of from
+var base = `{{ if .From -}}
+FROM {{.From}} AS base
+{{- else -}}
+FROM ubuntu:{{.UbuntuVersion}} AS ubuntu
+{{- end }}
 
 ENV DEBIAN_FRONTEND=nointeractive
 
-# for bootloader/grub and kernel image
+# for bootloader/grub and kernel image, an image from has its own kernel
+# unless one is set
+{{- if .Kernel }}
 ARG KERNEL_VERSION={{.Kernel}}
+{{- end }}
 RUN echo "link_in_boot=no" >> /etc/kernel-img.conf \
     && apt-get update \
     && apt-get install --no-install-recommends -y \
         grub-pc \
         grub-efi-amd64-bin \
         grub-efi-amd64-signed \
+{{- if .Kernel }}
         linux-image-${KERNEL_VERSION}-generic \
         linux-modules-extra-${KERNEL_VERSION}-generic \
+{{- end }}
         initramfs-tools \
         intel-microcode
-
+{{ if .Kernel }}
 RUN update-initramfs -k ${KERNEL_VERSION}-generic -c
-
+{{ end }}
 # for systemd, and /sbin/init
 RUN apt-get install --no-install-recommends -y \
         systemd \
@@ -60,9 +69,12 @@ RUN apt-get update \
 {{end}}
 
 # handle files
-# files are created first in buildcontext/tree
+# files are created first in buildcontext/tree, then appended and chowned
 {{ if .Files }}
 COPY tree/ /
+{{- with fileCommands .Files }}
+RUN {{ join . " \\\n    && " }}
+{{- end }}
 {{end}}
 `
 
@@ -89,20 +101,8 @@ func BuildImageFromConfig(c *Config) (string, error) {
 		log.Fatal(err)
 	}
 
-	// create "${tmpDir}/tree" for files in c.Files
-	// and in dockerfile they will be copied over using COPY tree/ /
-	generateFilesIfAny(c, path.Join(tmpDir, "tree"))
-
-	dockerfileContent := generateDockerfileContent(c)
-	log.Printf("[info] dockerfile content is %s\n", dockerfileContent)
-
-	dockerfile, err := os.Create(path.Join(tmpDir, "Dockerfile"))
-	if err != nil {
-		log.Fatalf("Fail to create a Dockerfile %s\n", err)
-	}
-
-	if _, err := dockerfile.Write([]byte(dockerfileContent)); err != nil {
-		log.Fatalf("Fail to write files %s\n", err)
+	if err := renderBuildContext(c, tmpDir); err != nil {
+		log.Fatalf("Fail to write the build context %s\n", err)
 	}
 
 	log.Printf("[info] build image from %s\n", tmpDir)
@@ -157,12 +157,71 @@ func BuildImageFromConfig(c *Config) (string, error) {
 	return imageId, nil
 }
 
+// renderMark is written next to the tree of a build context, a tree without
+// it is not replaced
+const renderMark = ".d2b-render"
+
+// checkRenderDir return an error if dir has a tree that was not rendered,
+// since the tree is replaced by renderBuildContext
+func checkRenderDir(dir string) error {
+	tree := path.Join(dir, "tree")
+	entries, err := ioutil.ReadDir(tree)
+	if os.IsNotExist(err) || (err == nil && len(entries) == 0) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path.Join(dir, renderMark)); err != nil {
+		return fmt.Errorf("%s is not empty and was not rendered by docker2boot, remove it or use another directory", tree)
+	}
+	return nil
+}
+
+// renderBuildContext write the Dockerfile of the config to dir, with the
+// files of c.Files in dir/tree
+func renderBuildContext(c *Config, dir string) error {
+	// create "${dir}/tree" for files in c.Files
+	// and in dockerfile they will be copied over using COPY tree/ /
+	tree := path.Join(dir, "tree")
+	if err := checkRenderDir(dir); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(tree); err != nil {
+		return err
+	}
+	generateFilesIfAny(c, tree)
+
+	dockerfileContent := generateDockerfileContent(c)
+	log.Printf("[info] dockerfile content is %s\n", dockerfileContent)
+	if err := ioutil.WriteFile(path.Join(dir, "Dockerfile"), []byte(dockerfileContent), 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(dir, renderMark), []byte("tree/ is replaced by docker2boot render\n"), 0644)
+}
+
+// parseDockerfileTemplate parse c.DockerfileTemplate, or base if not set
+func parseDockerfileTemplate(c *Config) (*template.Template, error) {
+	funcs := template.FuncMap{"fileCommands": fileCommands}
+	for name, f := range configTemplateFuncs {
+		funcs[name] = f
+	}
+	text := base
+	if c.DockerfileTemplate != "" {
+		data, err := ioutil.ReadFile(c.DockerfileTemplate)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	return template.New("dockerfile").Funcs(funcs).Parse(text)
+}
+
 // generate dockerfile using config from template
 func generateDockerfileContent(c *Config) string {
-	var funcs = template.FuncMap{"join": strings.Join}
 	w := bytes.NewBufferString("")
 	log.Printf("dockerfile %#v \n", *c)
-	tmpl, err := template.New("dockerfile").Funcs(funcs).Parse(base)
+	tmpl, err := parseDockerfileTemplate(c)
 	if err != nil {
 		log.Fatalf("Fail to parse the dockerfile template %s\n", err)
 	}
@@ -175,30 +234,12 @@ func generateDockerfileContent(c *Config) string {
 
 // generate files in dir using content from Config.Files
 func generateFilesIfAny(c *Config, dir string) {
-	if len(c.Files) == 0 {
-		return
-	}
-
-	for _, f := range c.Files {
-		// default set as 0644
-		var perm uint64 = 0644
-		var err error
-		if f.Mode != "" {
-			perm, err = strconv.ParseUint(f.Mode, 8, 0)
-			if err != nil {
-				log.Fatalf("Fail to parse file mode %s %s\n", f.Path, f.Mode)
-			}
-		}
-		targetFile := path.Join(dir, f.Path)
-		// dir need the x bits for owner (a.k.a need the 7) so that owner can read the conents
-		// so 775 is the correct permission for directoryies
-		if err := os.MkdirAll(path.Dir(targetFile), 0775); err != nil {
-			log.Fatalf("Fail to create dir for files %s\n", err)
-		}
-		if err := os.WriteFile(targetFile, []byte(f.Content), os.FileMode(perm)); err != nil {
+	for i := range c.Files {
+		f := &c.Files[i]
+		if err := f.writeTree(dir, i, c); err != nil {
 			log.Fatalf("Fail to create file %s %s\n", f.Path, err)
 		}
 
-		log.Printf("[Info] create file %s mode %s\n", f.Path, f.Mode)
+		log.Printf("[Info] create %s %s mode %s\n", f.fileType(), f.Path, f.Mode)
 	}
 }
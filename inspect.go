@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/binchenx/guestfs"
+)
+
+// inspect an existing disk read-only: its partitions, filesystems, logical
+// volumes, the A/B slot booted first and the installed os
+
+func runInspect(cmd *command, args []string) error {
+	fs := cmd.flagSet()
+	debug := fs.Bool("debug", false, "enable debug message")
+	if err := cmd.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return usageError("should specify one disk")
+	}
+	disk := fs.Arg(0)
+	if _, err := os.Stat(disk); err != nil {
+		return usageError("%s", err)
+	}
+
+	g, err := guestfs.Create()
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if *debug {
+		g.Set_trace(true)
+	}
+	if gerr := g.Add_drive(disk, &guestfs.OptargsAdd_drive{
+		Format_is_set:   true,
+		Format:          diskImageFormat(disk),
+		Readonly_is_set: true,
+		Readonly:        true,
+	}); gerr != nil {
+		return fmt.Errorf("fail to add %s %s", disk, gerr.Errmsg)
+	}
+	if gerr := g.Launch(); gerr != nil {
+		return fmt.Errorf("fail to launch %s", gerr.Errmsg)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "DEVICE\tNAME\tSIZE\tFSTYPE\tLABEL")
+	partitions, gerr := g.List_partitions()
+	if gerr != nil {
+		return fmt.Errorf("fail to list partitions %s", gerr.Errmsg)
+	}
+	esp := ""
+	for _, p := range partitions {
+		name := partitionName(g, p)
+		if name == PartitionNameEFI {
+			esp = p
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", p, name, deviceSize(g, p), vfsType(g, p), vfsLabel(g, p))
+	}
+	lvs, gerr := g.Lvs()
+	if gerr != nil {
+		return fmt.Errorf("fail to list logical volumes %s", gerr.Errmsg)
+	}
+	for _, lv := range lvs {
+		fmt.Fprintf(w, "%s\t\t%s\t%s\t%s\n", lv, deviceSize(g, lv), vfsType(g, lv), vfsLabel(g, lv))
+	}
+	w.Flush()
+
+	if esp != "" {
+		if slot, ok := inspectActiveSlot(g, esp); ok {
+			fmt.Printf("\nA/B slot booted first: %s\n", slot)
+		}
+	}
+
+	// inspection fails on an encrypted or verity root, which isn't an error
+	roots, gerr := g.Inspect_os()
+	if gerr == nil {
+		for _, root := range roots {
+			product, gerr := g.Inspect_get_product_name(root)
+			if gerr != nil {
+				continue
+			}
+			fmt.Printf("\nos on %s: %s\n", root, product)
+		}
+	}
+	return nil
+}
+
+// partitionName return the gpt name of the partition, empty for mbr
+func partitionName(g *guestfs.Guestfs, partition string) string {
+	n, err := g.Part_to_partnum(partition)
+	if err != nil {
+		return ""
+	}
+	device, err := g.Part_to_dev(partition)
+	if err != nil {
+		return ""
+	}
+	name, err := g.Part_get_name(device, n)
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+func deviceSize(g *guestfs.Guestfs, device string) string {
+	size, err := g.Blockdev_getsize64(device)
+	if err != nil {
+		return "?"
+	}
+	return fmt.Sprintf("%dM", size/(1024*1024))
+}
+
+// vfsType return the filesystem of device, empty if not formatted
+func vfsType(g *guestfs.Guestfs, device string) string {
+	fstype, err := g.Vfs_type(device)
+	if err != nil {
+		return ""
+	}
+	return fstype
+}
+
+func vfsLabel(g *guestfs.Guestfs, device string) string {
+	label, err := g.Vfs_label(device)
+	if err != nil {
+		return ""
+	}
+	return label
+}
+
+// inspectActiveSlot read the slot booted first from the grubenv of the efi
+// partition, false if the disk has no A/B slots
+func inspectActiveSlot(g *guestfs.Guestfs, esp string) (string, bool) {
+	if err := g.Mount_ro(esp, "/"); err != nil {
+		return "", false
+	}
+	defer g.Umount_all()
+	data, err := g.Cat("/grub/grubenv")
+	if err != nil {
+		return "", false
+	}
+	env := parseGrubenv(data)
+	if env["ORDER"] == "" {
+		return "", false
+	}
+	slot := abActiveSlot(env)
+	return fmt.Sprintf("%s (tries left %s, ok %s), order %s", slot, env[slot+"_LEFT"], env[slot+"_OK"], strings.Join(strings.Fields(env["ORDER"]), " ")), true
+}
+
+// diskImageFormat guess the qemu format of a disk from its extension
+func diskImageFormat(disk string) string {
+	switch strings.ToLower(strings.TrimPrefix(filepath.Ext(disk), ".")) {
+	case "qcow2":
+		return OutputFormatQcow2
+	case "vhd":
+		return "vpc"
+	case "vmdk":
+		return OutputFormatVmdk
+	}
+	return OutputFormatRaw
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/binchenx/guestfs"
+)
+
+// hybrid live iso booting from cd or usb, with bios and uefi
+//
+// The root of the built disk is packed in a squashfs mounted by the casper
+// initramfs, with the kernel and the initrd. grub-mkrescue creates the El
+// Torito and GPT boot records.
+
+const OutputFormatIso = "iso"
+
+const (
+	// casper finds the squashfs in /casper of any media
+	liveDir       = "casper"
+	liveSquashfs  = "filesystem.squashfs"
+	liveKernel    = "vmlinuz"
+	liveInitrd    = "initrd"
+	liveVolumeID  = "D2B_LIVE"
+	casperScripts = "/usr/share/initramfs-tools/scripts/casper"
+)
+
+const liveGrubCfgData = `set timeout=5
+serial --speed=115200 --unit=0 --word=8 --parity=no --stop=1
+terminal_input serial console
+terminal_output serial console
+
+menuentry "%s" {
+	linux /` + liveDir + `/` + liveKernel + ` boot=casper %s
+	initrd /` + liveDir + `/` + liveInitrd + `
+}
+`
+
+// validateLive make sure root can be read from the layout to be made live
+func (d *DiskLayout) validateLive() error {
+	if d.Verity != nil || d.AB != nil || d.hasEncryptedPartitions() {
+		return fmt.Errorf("a live root can not be made from a verity, A/B or encrypted layout")
+	}
+	return nil
+}
+
+// extractLiveRoot write the kernel, the initrd built with initramfsScripts and
+// the squashfs of the root of the disk to dir
+func extractLiveRoot(raw string, layout *DiskLayout, initramfsScripts string, dir string) error {
+	if err := layout.validateLive(); err != nil {
+		return err
+	}
+
+	g, errno := guestfs.Create()
+	if errno != nil {
+		return errno
+	}
+	defer g.Close()
+
+	// the raw disk is removed after, the initramfs is updated in place
+	optargs := guestfs.OptargsAdd_drive{
+		Format_is_set: true,
+		Format:        "raw",
+	}
+	if err := g.Add_drive(raw, &optargs); err != nil {
+		return fmt.Errorf("%s", err.Errmsg)
+	}
+	if err := g.Launch(); err != nil {
+		return fmt.Errorf("%s", err.Errmsg)
+	}
+	setupRootfs(g, "", layout)
+
+	if exists, _ := g.Exists(initramfsScripts); !exists {
+		return fmt.Errorf("%s not found, the initramfs scripts booting the live root are not installed in the image", initramfsScripts)
+	}
+	log.Println("[Info] Update initramfs")
+	if out, err := g.Command([]string{"update-initramfs", "-u", "-k", "all"}); err != nil {
+		return fmt.Errorf("fail to update initramfs %s %s", out, err.Errmsg)
+	}
+
+	files := map[string]string{
+		"/vmlinuz":    liveKernel,
+		"/initrd.img": liveInitrd,
+	}
+	for src, dest := range files {
+		if err := g.Download(src, filepath.Join(dir, dest)); err != nil {
+			return fmt.Errorf("fail to copy %s %s", src, err.Errmsg)
+		}
+	}
+
+	log.Println("[Info] Create squashfs root")
+	err := g.Mksquashfs("/", filepath.Join(dir, liveSquashfs), &guestfs.OptargsMksquashfs{
+		Compress_is_set: true,
+		Compress:        "xz",
+	})
+	if err != nil {
+		return fmt.Errorf("fail to create squashfs %s", err.Errmsg)
+	}
+
+	if err := g.Umount_all(); err != nil {
+		return fmt.Errorf("%s", err.Errmsg)
+	}
+	if err := g.Shutdown(); err != nil {
+		return fmt.Errorf("%s", err.Errmsg)
+	}
+	return nil
+}
+
+// packIso create the live iso of the raw disk
+func packIso(raw string, out string, vm *virtualMachine) error {
+	dir, err := ioutil.TempDir(filepath.Dir(out), "d2b-iso")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	for _, d := range []string{liveDir, "boot/grub"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return err
+		}
+	}
+	if err := extractLiveRoot(raw, vm.Layout, casperScripts, filepath.Join(dir, liveDir)); err != nil {
+		return err
+	}
+	cfg := fmt.Sprintf(liveGrubCfgData, vm.Name, vm.KernelCmdline)
+	if err := ioutil.WriteFile(filepath.Join(dir, "boot/grub/grub.cfg"), []byte(cfg), 0644); err != nil {
+		return err
+	}
+
+	cmd := exec.Command("grub-mkrescue", "-o", out, dir, "--", "-volid", liveVolumeID)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("grub-mkrescue %s: %s", err, output)
+	}
+	return os.Remove(raw)
+}
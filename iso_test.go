@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestLiveGrubCfg(t *testing.T) {
+	cfg := fmt.Sprintf(liveGrubCfgData, "myos", defaultKernelCmdline)
+	if !strings.Contains(cfg, "linux /casper/vmlinuz boot=casper "+defaultKernelCmdline+"\n") ||
+		!strings.Contains(cfg, "initrd /casper/initrd\n") {
+		t.Errorf("unexpected grub.cfg\n%s", cfg)
+	}
+}
+
+func TestValidateLive(t *testing.T) {
+	if err := NewDefaultLayout().validateLive(); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+	if err := NewABLayout().validateLive(); err == nil {
+		t.Errorf("expected error for the A/B layout")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// libvirt domain running the disk, with virtio disk and nics and the serial
+// console, see https://libvirt.org/formatdomain.html
+
+var libvirtDomainTemplate = template.Must(template.New("domain").Funcs(template.FuncMap{"xml": xmlEscape}).Parse(`<domain type='kvm'>
+  <name>{{ xml .VM.Name }}</name>
+  <memory unit='MiB'>{{ .VM.Memory }}</memory>
+  <vcpu>{{ .VM.CPUs }}</vcpu>
+  <os{{ if eq .VM.Firmware "efi" }} firmware='efi'{{ end }}>
+    <type arch='x86_64' machine='q35'>hvm</type>
+    <boot dev='hd'/>
+  </os>
+  <features>
+    <acpi/>
+    <apic/>
+  </features>
+  <cpu mode='host-passthrough'/>
+  <devices>
+    <disk type='file' device='disk'>
+      <driver name='qemu' type='{{ .Format }}'/>
+      <source file='{{ xml .Disk }}'/>
+      <target dev='vda' bus='virtio'/>
+    </disk>
+{{- range .NICs }}
+    <interface type='network'>
+      <source network='default'/>
+      <model type='virtio'/>
+    </interface>
+{{- end }}
+    <serial type='pty'>
+      <target port='0'/>
+    </serial>
+    <console type='pty'>
+      <target type='serial' port='0'/>
+    </console>
+  </devices>
+</domain>
+`))
+
+// libvirtDomain return the domain xml of vm running disk in format
+func libvirtDomain(vm *virtualMachine, disk string, format string) (string, error) {
+	if format != OutputFormatRaw && format != OutputFormatQcow2 {
+		return "", fmt.Errorf("libvirt domain needs a raw or qcow2 disk, not %s", format)
+	}
+	abs, err := filepath.Abs(disk)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	err = libvirtDomainTemplate.Execute(&buf, map[string]interface{}{
+		"VM":     vm,
+		"Disk":   abs,
+		"Format": format,
+		"NICs":   make([]struct{}, vm.NICs),
+	})
+	return buf.String(), err
+}
+
+// libvirtDomainFile return the domain xml file next to the disk
+func libvirtDomainFile(disk string) string {
+	return strings.TrimSuffix(disk, filepath.Ext(disk)) + ".xml"
+}
+
+// writeLibvirtDomain write the domain xml next to the disk, to be used with
+// virsh define
+func writeLibvirtDomain(vm *virtualMachine, disk string, format string) error {
+	domain, err := libvirtDomain(vm, disk, format)
+	if err != nil {
+		return err
+	}
+	file := libvirtDomainFile(disk)
+	log.Printf("[Info] Write libvirt domain %s\n", file)
+	return ioutil.WriteFile(file, []byte(domain), 0644)
+}
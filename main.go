@@ -1,71 +1,605 @@
 package main
 
 import (
+	_ "embed"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+//go:embed VERSION
+var version string
+
+// exit codes by failure class, a log.Fatal exits with exitFailure
+const (
+	exitOK = 0
+	// the build or the command failed
+	exitFailure = 1
+	// wrong command or flags
+	exitUsage = 2
+	// the config or the disk layout is invalid
+	exitInvalid = 3
+	// the docker image can't be built or unpacked
+	exitImage = 4
 )
 
+// exitError is an error with the exit code of its failure class
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func usageError(format string, a ...interface{}) error {
+	return &exitError{exitUsage, fmt.Errorf(format, a...)}
+}
+
+func invalidError(err error) error {
+	return &exitError{exitInvalid, err}
+}
+
+type command struct {
+	name string
+	// args is the usage after the command name
+	args    string
+	summary string
+	run     func(cmd *command, args []string) error
+}
+
+// commands in the order of the usage, filled in init as they refer to it
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"build", "[-image <image>] [-config <config.yaml>] [flags]", "create a bootable disk from a docker image, a config or a config layered on an image", runBuild},
+		{"validate", "[-config <config.yaml>] [flags]", "check the config, the disk layout, the target and the format without building", runValidate},
+		{"inspect", "[flags] <disk>", "show the partitions, filesystems, A/B slots and os of a disk", runInspect},
+		{"boot", "[flags] <disk>", "boot a disk with qemu on the console, changes are discarded", runBoot},
+		{"layout", "show [flags]", "show a disk layout with its fstab and kernel cmdline", runLayout},
+		{"render", "-config <config.yaml> [-image <image>] [-output <dir>] [flags]", "write the Dockerfile and the tree/ build context of a config to a directory, without building", runRender},
+		{"render-dockerfile", "-config <config.yaml> [-image <image>] [flags]", "print the Dockerfile generated from a config", runRenderDockerfile},
+		{"version", "", "print the version", runVersion},
+	}
+}
+
 func main() {
-	pImage := flag.String("image", "", "the user specified os base image")
-	pConfig := flag.String("config", "", "the yaml config")
-	pOut := flag.String("output", "disk.img", "the output bootable disk image")
-	pDebug := flag.Bool("debug", false, "enable debug message")
-	layoutFile := flag.String("diskLayout", "", "disk partitions layout, if not provided use the default")
+	os.Exit(runCommand(os.Args[1:]))
+}
+
+func isHelp(arg string) bool {
+	return arg == "-h" || arg == "-help" || arg == "--help" || arg == "help"
+}
 
-	flag.Parse()
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "usage: docker2boot <command> [flags]\n\ncommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-18s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(w, "\nrun docker2boot <command> -h for the flags of a command\n")
+}
 
-	if *pImage == "" && *pConfig == "" {
-		log.Printf("Error: should specify either -image or -config")
-		flag.Usage()
+// runCommand run the command of args and return the exit code
+func runCommand(args []string) int {
+	if len(args) == 0 {
+		usage()
+		return exitUsage
+	}
+	if isHelp(args[0]) {
+		usage()
+		return exitOK
+	}
+	// docker2boot -image ... keeps working as a build
+	if strings.HasPrefix(args[0], "-") {
+		args = append([]string{"build"}, args...)
 	}
 
-	if *pImage == "" {
-		config, _ := getConfigFromFile(*pConfig)
-		log.Printf("config %#v\n", config)
-		imageId, err := BuildImageFromConfig(config)
-		if err != nil {
-			log.Fatalf("Fail to create image %s with built-in setup\n", err)
+	for _, c := range commands {
+		if c.name != args[0] {
+			continue
+		}
+		err := c.run(c, args[1:])
+		if err == nil || errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		// a config has an error per line
+		for _, line := range strings.Split(err.Error(), "\n") {
+			log.Printf("Error: %s\n", line)
 		}
-		*pImage = imageId
+		var e *exitError
+		if errors.As(err, &e) {
+			return e.code
+		}
+		return exitFailure
 	}
+	log.Printf("Error: unknown command %s\n", args[0])
+	usage()
+	return exitUsage
+}
 
-	log.Printf("[Info] Create boot image from docker image %s\n", *pImage)
+func (c *command) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: docker2boot %s %s\n\n%s\n\nflags:\n", c.name, c.args, c.summary)
+		fs.PrintDefaults()
+	}
+	return fs
+}
 
-	var layout *DiskLayout
-	if *layoutFile != "" {
-		layout = parseDisklayout(*layoutFile)
+// parse the flags, a -h is returned as flag.ErrHelp
+func (c *command) parse(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		return &exitError{exitUsage, err}
+	}
+	return nil
+}
+
+// stringsFlag is a repeatable flag
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, " ")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// buildOptions are the flags describing the disk to create
+type buildOptions struct {
+	image        string
+	config       string
+	output       string
+	debug        bool
+	diskLayout   string
+	layoutPreset string
+	updateSlot   string
+	target       string
+	format       string
+	// noGeneralize skip the generalize operations, whatever the config
+	noGeneralize bool
+	// rendered tell the image was built from the render of the config
+	rendered bool
+	// dockerfileTemplate overrides the template of the config
+	dockerfileTemplate string
+	// env is the environment overlay of the config and sets the values set
+	env           string
+	sets          stringsFlag
+	libvirtXML    bool
+	netbootURL    string
+	netbootRoot   string
+	microvmKernel string
+	s3Upload      bool
+	s3Endpoint    string
+	s3Region      string
+	s3Bucket      string
+	s3Key         string
+	contents      contentFlags
+	additions     additionFlags
+}
 
+// registerSource register the flags of the config and the layout, shared by
+// the commands checking them
+func (o *buildOptions) registerSource(fs *flag.FlagSet) {
+	fs.StringVar(&o.image, "image", "", "the user specified os base image, with -config the image the config is applied on, overriding from:")
+	fs.StringVar(&o.config, "config", "", "the yaml config")
+	fs.StringVar(&o.diskLayout, "diskLayout", "", "disk partitions layout, if not provided use the default")
+	fs.StringVar(&o.layoutPreset, "layoutPreset", "default", "built-in disk layout used if -diskLayout is not provided: default or ab")
+	fs.StringVar(&o.target, "target", "", "the platform the disk boots on: "+strings.Join(targetNames(), ", ")+", overrides the config")
+	fs.BoolVar(&o.noGeneralize, "noGeneralize", false, "keep the machine-id, ssh host keys, logs... of the image, like generalize: {disabled: true} in the config")
+	fs.StringVar(&o.env, "env", "", "environment of the config merged on top of it, e.g. dev, stage or prod")
+	fs.Var(&o.sets, "set", "set a value of the config, repeatable: <key>=<yaml value>, the key a dotted path like vm.memory")
+	fs.StringVar(&o.dockerfileTemplate, "dockerfileTemplate", "", "text/template of the Dockerfile replacing the built-in one, overrides the config")
+	fs.StringVar(&o.format, "format", "", "output disk format: raw, qcow2, vhd, vmdk, gce, ova, vagrant-libvirt, vagrant-virtualbox, iso, pxe or microvm, default to the format of the target. pxe and microvm write their artefacts to the -output directory")
+}
+
+func (o *buildOptions) register(fs *flag.FlagSet) {
+	o.registerSource(fs)
+	fs.StringVar(&o.output, "output", "disk.img", "the output bootable disk image")
+	fs.BoolVar(&o.debug, "debug", false, "enable debug message")
+	fs.BoolVar(&o.rendered, "rendered", false, "with -image and -config, the image was built from the render of the config: it is not built again and only the settings applied to the disk are read from the config")
+	fs.StringVar(&o.updateSlot, "updateSlot", "", "write the image to the inactive slot of this existing A/B disk instead of creating a disk")
+	fs.BoolVar(&o.libvirtXML, "libvirtXML", false, "write the libvirt domain xml running the disk next to it, the format should be raw or qcow2")
+	fs.StringVar(&o.netbootURL, "netbootURL", "http://<server>/d2b", "url the pxe artefacts are served from, used in the sample boot configs")
+	fs.StringVar(&o.netbootRoot, "netbootRoot", NetbootRootSquashfs, "root of the pxe artefacts: squashfs or cpio")
+	fs.StringVar(&o.microvmKernel, "microvmKernel", "", "kernel of the microvm, a vmlinux or a bzImage, default to the kernel of the image")
+	fs.BoolVar(&o.s3Upload, "s3Upload", false, "upload the disk to -s3Bucket, credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	fs.StringVar(&o.s3Endpoint, "s3Endpoint", "", "s3 compatible endpoint, default to aws s3 of -s3Region")
+	fs.StringVar(&o.s3Region, "s3Region", "us-east-1", "s3 region")
+	fs.StringVar(&o.s3Bucket, "s3Bucket", "", "s3 bucket of the disk for the aws import")
+	fs.StringVar(&o.s3Key, "s3Key", "", "s3 key of the disk, default to the output file name")
+	fs.Var(&o.contents, "content", "additional content, repeatable: type=tar|dir|image,source=<path or image>[,dest=<dir>][,partition=<name>]")
+	fs.Var(&o.additions, "add", "copy a host file or directory to the guest, repeatable: <host path>:<guest path>[:<owner>[:<group>[:<mode>]]]")
+}
+
+func (o *buildOptions) loadLayout() (*DiskLayout, error) {
+	var layout *DiskLayout
+	if o.diskLayout != "" {
+		var err error
+		layout, err = parseDisklayout(o.diskLayout)
+		if err != nil {
+			return nil, invalidError(fmt.Errorf("fail to parse disk layout %s", err))
+		}
 	} else {
-		layout = NewDefaultLayout()
+		preset, ok := layoutPresets[o.layoutPreset]
+		if !ok {
+			return nil, usageError("unknown disk layout preset %s", o.layoutPreset)
+		}
+		layout = preset()
 	}
-
 	if err := layout.validate(); err != nil {
-		log.Fatalf("invalid paritions setting %s", err)
+		return nil, invalidError(fmt.Errorf("invalid paritions setting %s", err))
+	}
+	return layout, nil
+}
+
+// buildPlan is the disk described by the options
+type buildPlan struct {
+	layout *DiskLayout
+	// config also customizes the guest, it is empty for a user image
+	config *Config
+	// fromImage is true if the image is used as is, without config
+	fromImage bool
+	target    *Target
+	format    string
+}
+
+// load read and check the config and the layout, the config gets the
+// packages needed by the layout and the format
+func (o *buildOptions) load() (*buildPlan, error) {
+	layout, err := o.loadLayout()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &buildPlan{layout: layout, config: &Config{}, fromImage: o.config == "" || o.rendered}
+	if o.config == "" && (o.env != "" || len(o.sets) != 0) {
+		return nil, usageError("-env and -set need -config")
+	}
+	if o.rendered && (o.image == "" || o.config == "") {
+		return nil, usageError("-rendered needs -image and -config")
 	}
+	if o.config != "" {
+		if p.config, err = loadConfig(o.config, o.env, o.sets); err != nil {
+			return nil, invalidError(err)
+		}
+		// the config is layered on the image
+		if o.image != "" && !o.rendered {
+			p.config.From = o.image
+		}
+		if o.dockerfileTemplate != "" {
+			p.config.DockerfileTemplate = o.dockerfileTemplate
+		}
+	}
+	if o.target != "" {
+		p.config.Target = o.target
+	}
+	if o.noGeneralize {
+		p.config.Generalize = &Generalize{Disabled: true}
+	}
+	validate := p.config.validateImage
+	if p.fromImage {
+		validate = p.config.validate
+	}
+	if err := validate(); err != nil {
+		return nil, invalidError(err)
+	}
+	p.target, _ = p.config.target()
+	// the packages of the target are in a rendered image already
+	p.config.applyTarget(p.target, p.fromImage && !o.rendered)
+
+	p.format = p.target.OutputFormat
+	if o.format != "" {
+		p.format = o.format
+	}
+	if err := validateOutputFormat(p.format); err != nil {
+		return nil, usageError("%s", err)
+	}
+	if p.format == OutputFormatIso {
+		if err := layout.validateLive(); err != nil {
+			return nil, invalidError(err)
+		}
+	}
+	if p.format == OutputFormatPxe {
+		if err := o.netboot().validate(); err != nil {
+			return nil, usageError("%s", err)
+		}
+	}
+	if o.libvirtXML && p.format != OutputFormatRaw && p.format != OutputFormatQcow2 {
+		return nil, usageError("-libvirtXML needs a raw or qcow2 disk, not %s", p.format)
+	}
+	if _, ok := awsImportFormats[p.format]; p.target.Name == "aws" && !ok {
+		return nil, usageError("-target aws imports a raw, vhd or vmdk disk, not %s", p.format)
+	}
+	if o.s3Upload && o.s3Bucket == "" {
+		return nil, usageError("-s3Upload needs -s3Bucket")
+	}
+	if o.updateSlot != "" {
+		// the slot is written in place, the disk is not converted nor uploaded
+		switch {
+		case o.format != "":
+			return nil, usageError("-updateSlot writes the existing raw disk, -format can't be used")
+		case o.libvirtXML:
+			return nil, usageError("-updateSlot can't be used with -libvirtXML")
+		case o.s3Upload:
+			return nil, usageError("-updateSlot can't be used with -s3Upload")
+		}
+		if layout.AB == nil {
+			return nil, invalidError(fmt.Errorf("-updateSlot needs an A/B layout, e.g. -layoutPreset ab"))
+		}
+		if layout.hasEncryptedPartitions() || len(layout.VolumeGroups) != 0 {
+			return nil, invalidError(fmt.Errorf("-updateSlot doesn't support encrypted partitions nor volume groups"))
+		}
+	}
+
+	if !p.fromImage {
+		// the tools needed by the layout at boot time are installed with the image
+		for _, t := range layout.requiredGuestTools() {
+			p.config.Packages = append(p.config.Packages, t.Package)
+		}
+		p.config.Packages = append(p.config.Packages, outputPackages[p.format]...)
+	}
+	return p, nil
+}
+
+func (o *buildOptions) netboot() *Netboot {
+	// the commands only checking the config don't register the netboot flags
+	n := &Netboot{URL: o.netbootURL, Root: o.netbootRoot}
+	if n.Root == "" {
+		n.Root = NetbootRootSquashfs
+	}
+	return n
+}
+
+func runBuild(cmd *command, args []string) error {
+	var o buildOptions
+	fs := cmd.flagSet()
+	o.register(fs)
+	if err := cmd.parse(fs, args); err != nil {
+		return err
+	}
+	if o.image == "" && o.config == "" {
+		fs.Usage()
+		return usageError("should specify -image, -config or both")
+	}
+
+	p, err := o.load()
+	if err != nil {
+		return err
+	}
+	config, layout, target, format := p.config, p.layout, p.target, p.format
+
+	contentSources := append(config.Contents, o.contents...)
+	additions := append(config.Add, o.additions...)
+	image := o.image
+	if !p.fromImage {
+		log.Printf("config %#v\n", config)
+		imageId, err := BuildImageFromConfig(config)
+		if err != nil {
+			return &exitError{exitImage, fmt.Errorf("fail to create image %s with built-in setup", err)}
+		}
+		image = imageId
+	}
+
+	log.Printf("[Info] Create boot image from docker image %s\n", image)
 
 	const GB = 1024 * 1024 * 1024
 
-	// output disk
+	// output disk, built raw and converted to format after
 	disk := Disk{
-		Name: *pOut,
+		Name: o.output,
 		Size: 2 * GB,
 	}
+	if o.updateSlot == "" && format != OutputFormatPxe && format != OutputFormatMicrovm {
+		if disk.Name, err = prepareRawDisk(o.output, format); err != nil {
+			return fmt.Errorf("fail to create disk %s", err)
+		}
+	}
 
-	// build the imgage from the config
+	// an updated disk has its cloud-init partition already
+	if config.CloudInit != nil && config.CloudInit.seed() == CloudInitSeedPartition && o.updateSlot == "" {
+		if err := layout.addCloudInitPartition(disk.Size); err != nil {
+			return invalidError(fmt.Errorf("invalid paritions setting %s", err))
+		}
+	}
 
-	outTar, err := UnpackDockerImage(*pImage)
+	outTar, err := UnpackDockerImage(image)
 	if err != nil {
-		log.Fatalf("Fail to unpack docker image %s\n", err)
+		return &exitError{exitImage, fmt.Errorf("fail to unpack docker image %s", err)}
 	}
 
 	// root filesystem content
 	content := &[]Content{
 		{
 			source:     outTar,
-			sourceType: "tar",
+			sourceType: ContentTypeTar,
 			destDir:    "/",
 		},
 	}
 
-	CreateBootableImage(disk, layout, content, *pDebug)
+	extraContents, err := resolveContents(contentSources)
+	if err != nil {
+		return &exitError{exitImage, fmt.Errorf("fail to get contents %s", err)}
+	}
+	*content = append(*content, extraContents...)
+
+	addContents, err := resolveAdditions(additions)
+	if err != nil {
+		return fmt.Errorf("fail to get files to add %s", err)
+	}
+	*content = append(*content, addContents...)
+
+	if o.updateSlot != "" {
+		disk.Name = o.updateSlot
+		UpdateInactiveSlot(disk, layout, content, config, o.debug)
+		return nil
+	}
+
+	vm := newVirtualMachine(o.output, config.VM, layout, disk, target.KernelCmdline)
+	switch format {
+	case OutputFormatPxe:
+		CreateNetbootArtefacts(o.output, disk.Size, content, config, *o.netboot(), o.debug)
+		return nil
+	case OutputFormatMicrovm:
+		CreateMicroVM(o.output, disk.Size, content, config, vm, o.microvmKernel, o.debug)
+		return nil
+	}
+
+	CreateBootableImage(disk, layout, content, config, o.debug)
+	if err := convertDisk(disk.Name, o.output, format, vm); err != nil {
+		return fmt.Errorf("fail to convert disk %s", err)
+	}
+	disk.Name = o.output
+
+	if o.libvirtXML {
+		if err := writeLibvirtDomain(vm, o.output, format); err != nil {
+			return fmt.Errorf("fail to write libvirt domain %s", err)
+		}
+	}
+
+	location := S3Location{
+		Endpoint: o.s3Endpoint,
+		Region:   o.s3Region,
+		Bucket:   o.s3Bucket,
+		Key:      o.s3Key,
+	}
+	if location.Key == "" {
+		location.Key = filepath.Base(o.output)
+	}
+	if target.Name == "aws" {
+		if location.Bucket == "" {
+			log.Printf("[Info] -s3Bucket is not set, replace <bucket> in containers.json\n")
+			location.Bucket = "<bucket>"
+		}
+		if err := writeAwsImportFiles(disk, layout, target, location, format); err != nil {
+			return fmt.Errorf("fail to write aws import files %s", err)
+		}
+	}
+	if o.s3Upload {
+		creds, err := awsCredentialsFromEnv()
+		if err != nil {
+			return err
+		}
+		if err := uploadToS3(o.output, location, creds); err != nil {
+			return fmt.Errorf("fail to upload disk %s", err)
+		}
+	}
+	return nil
+}
+
+func runValidate(cmd *command, args []string) error {
+	var o buildOptions
+	fs := cmd.flagSet()
+	o.registerSource(fs)
+	if err := cmd.parse(fs, args); err != nil {
+		return err
+	}
+	p, err := o.load()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("ok: target %s, format %s, %d partitions\n", p.target.Name, p.format, len(p.layout.Partitions))
+	return nil
+}
+
+func runLayout(cmd *command, args []string) error {
+	if len(args) == 0 || isHelp(args[0]) {
+		cmd.flagSet().Usage()
+		if len(args) == 0 {
+			return usageError("missing layout command")
+		}
+		return nil
+	}
+	if args[0] != "show" {
+		return usageError("unknown layout command %s", args[0])
+	}
+
+	var o buildOptions
+	fs := cmd.flagSet()
+	o.registerSource(fs)
+	if err := cmd.parse(fs, args[1:]); err != nil {
+		return err
+	}
+	p, err := o.load()
+	if err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(p.layout)
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(data))
+	fmt.Printf("\n# fstab\n%s", p.layout.fstab())
+	fmt.Printf("\n# kernel cmdline\n%s\n", strings.TrimSpace(p.target.KernelCmdline+" "+p.layout.kernelCmdline()))
+	return nil
+}
+
+func runRender(cmd *command, args []string) error {
+	var o buildOptions
+	fs := cmd.flagSet()
+	o.registerSource(fs)
+	fs.StringVar(&o.output, "output", "build", "the directory of the build context")
+	if err := cmd.parse(fs, args); err != nil {
+		return err
+	}
+	if o.config == "" {
+		fs.Usage()
+		return usageError("should specify -config")
+	}
+	p, err := o.load()
+	if err != nil {
+		return err
+	}
+	if err := checkRenderDir(o.output); err != nil {
+		return usageError("%s", err)
+	}
+	if err := os.MkdirAll(o.output, 0755); err != nil {
+		return err
+	}
+	if err := renderBuildContext(p.config, o.output); err != nil {
+		return err
+	}
+	log.Printf("[Info] Write the build context to %s, build it with docker build %s\n", o.output, o.output)
+	return nil
+}
+
+func runRenderDockerfile(cmd *command, args []string) error {
+	var o buildOptions
+	fs := cmd.flagSet()
+	o.registerSource(fs)
+	if err := cmd.parse(fs, args); err != nil {
+		return err
+	}
+	if o.config == "" {
+		fs.Usage()
+		return usageError("should specify -config")
+	}
+	p, err := o.load()
+	if err != nil {
+		return err
+	}
+	fmt.Print(generateDockerfileContent(p.config))
+	return nil
+}
+
+func runVersion(cmd *command, args []string) error {
+	fs := cmd.flagSet()
+	if err := cmd.parse(fs, args); err != nil {
+		return err
+	}
+	fmt.Printf("docker2boot %s\n", strings.TrimSpace(version))
+	return nil
 }
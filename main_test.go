@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "d2b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "other", "tree", "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	bad := filepath.Join(dir, "bad.yaml")
+	if err := ioutil.WriteFile(bad, []byte("firstboot:\n  - name: a\n    content: x\n  - name: a\n    content: y\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args []string
+		code int
+	}{
+		{nil, exitUsage},
+		{[]string{"-h"}, exitOK},
+		{[]string{"unknown"}, exitUsage},
+		{[]string{"version"}, exitOK},
+		{[]string{"build", "--help"}, exitOK},
+		{[]string{"build"}, exitUsage},
+		{[]string{"-output", "disk.img"}, exitUsage},
+		{[]string{"build", "-nosuchflag"}, exitUsage},
+		{[]string{"validate", "-config", "config.yaml"}, exitOK},
+		{[]string{"validate", "-config", "config.yaml", "-target", "nosuchtarget"}, exitInvalid},
+		{[]string{"validate", "-config", "config.yaml", "-format", "nosuchformat"}, exitUsage},
+		{[]string{"validate", "-config", "nosuch.yaml"}, exitInvalid},
+		{[]string{"validate", "-config", bad}, exitInvalid},
+		{[]string{"validate", "-layoutPreset", "nosuch"}, exitUsage},
+		{[]string{"layout"}, exitUsage},
+		{[]string{"layout", "show", "-layoutPreset", "ab"}, exitOK},
+		{[]string{"render"}, exitUsage},
+		{[]string{"render", "-config", "config.yaml", "-output", filepath.Join(dir, "build")}, exitOK},
+		{[]string{"render", "-config", "config.yaml", "-output", filepath.Join(dir, "build")}, exitOK},
+		{[]string{"render", "-config", "config.yaml", "-output", filepath.Join(dir, "other")}, exitUsage},
+		{[]string{"build", "-image", "myos", "-rendered"}, exitUsage},
+		{[]string{"build", "-image", "myos", "-s3Upload"}, exitUsage},
+		{[]string{"validate", "-target", "aws", "-format", "qcow2"}, exitUsage},
+		{[]string{"build", "-image", "myos", "-layoutPreset", "ab", "-updateSlot", "disk.img", "-format", "qcow2"}, exitUsage},
+		{[]string{"build", "-image", "myos", "-updateSlot", "disk.img"}, exitInvalid},
+		{[]string{"render", "-config", "config.yaml", "-dockerfileTemplate", filepath.Join(dir, "nosuch")}, exitInvalid},
+		{[]string{"inspect"}, exitUsage},
+		{[]string{"boot", filepath.Join(dir, "nosuch.img")}, exitUsage},
+	}
+	for _, test := range tests {
+		if code := runCommand(test.args); code != test.code {
+			t.Errorf("%v: exit code %d, want %d", test.args, code, test.code)
+		}
+	}
+}
+
+func TestQemuBootArgs(t *testing.T) {
+	args, err := qemuBootArgs("disk.qcow2", bootOptions{cpus: 4, memory: 1024, firmware: FirmwareEfi, ovmf: defaultOvmf, kvm: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmdline := strings.Join(args, " ")
+	for _, want := range []string{"-snapshot", "-smp 4", "-m 1024", "file=disk.qcow2,if=virtio,format=qcow2", "-bios " + defaultOvmf, "-enable-kvm"} {
+		if !strings.Contains(cmdline, want) {
+			t.Errorf("qemu args %s should contain %s", cmdline, want)
+		}
+	}
+	if _, err := qemuBootArgs("disk.ova", bootOptions{firmware: FirmwareBios}); err == nil {
+		t.Errorf("an ova should not boot")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/binchenx/guestfs"
+)
+
+// microvm artefacts for firecracker: the uncompressed kernel, root on a whole
+// ext4 image and the vm config, no partition table, bootloader or initrd
+
+const OutputFormatMicrovm = "microvm"
+
+const (
+	microvmKernel = "vmlinux"
+	microvmRootfs = "rootfs.ext4"
+	microvmConfig = "vm_config.json"
+	// the root image is the first virtio block device
+	microvmCmdline = "console=ttyS0 reboot=k panic=1 pci=off root=/dev/vda rw init=/sbin/init"
+	// fstab of the root image
+	microvmFstab = "/dev/vda / ext4 defaults 0 1\n"
+)
+
+type firecrackerBootSource struct {
+	KernelImagePath string `json:"kernel_image_path"`
+	BootArgs        string `json:"boot_args"`
+}
+
+type firecrackerDrive struct {
+	DriveID      string `json:"drive_id"`
+	PathOnHost   string `json:"path_on_host"`
+	IsRootDevice bool   `json:"is_root_device"`
+	IsReadOnly   bool   `json:"is_read_only"`
+}
+
+type firecrackerMachineConfig struct {
+	VcpuCount  int `json:"vcpu_count"`
+	MemSizeMib int `json:"mem_size_mib"`
+}
+
+type firecrackerNetworkInterface struct {
+	IfaceID     string `json:"iface_id"`
+	HostDevName string `json:"host_dev_name"`
+}
+
+// firecrackerConfig is the --config-file of firecracker
+type firecrackerConfig struct {
+	BootSource        firecrackerBootSource         `json:"boot-source"`
+	Drives            []firecrackerDrive            `json:"drives"`
+	MachineConfig     firecrackerMachineConfig      `json:"machine-config"`
+	NetworkInterfaces []firecrackerNetworkInterface `json:"network-interfaces,omitempty"`
+}
+
+// newFirecrackerConfig return the config of vm, the paths are relative to the
+// output directory and the nics use the taps tap0, tap1...
+func newFirecrackerConfig(vm *virtualMachine) *firecrackerConfig {
+	c := &firecrackerConfig{
+		BootSource: firecrackerBootSource{
+			KernelImagePath: microvmKernel,
+			BootArgs:        microvmCmdline,
+		},
+		Drives: []firecrackerDrive{
+			{
+				DriveID:      "rootfs",
+				PathOnHost:   microvmRootfs,
+				IsRootDevice: true,
+			},
+		},
+		MachineConfig: firecrackerMachineConfig{
+			VcpuCount:  vm.CPUs,
+			MemSizeMib: vm.Memory,
+		},
+	}
+	for i := 0; i < vm.NICs; i++ {
+		c.NetworkInterfaces = append(c.NetworkInterfaces, firecrackerNetworkInterface{
+			IfaceID:     fmt.Sprintf("eth%d", i),
+			HostDevName: fmt.Sprintf("tap%d", i),
+		})
+	}
+	return c
+}
+
+// CreateMicroVM write the microvm artefacts of contents to dir, the root image
+// is size bytes. The kernel of the image is used unless kernel, a vmlinux or a
+// bzImage, is given.
+func CreateMicroVM(dir string, size int64, contents *[]Content, config *Config, vm *virtualMachine, kernel string, debug bool) {
+	log.Printf("[Info] Create microvm in %s\n", dir)
+	target, err := config.target()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	g := launchScratchRoot(filepath.Join(dir, microvmRootfs), size, "ROOT", config, debug)
+	defer g.Close()
+	populateScratchRoot(g, contents, config, target)
+	if err := g.Write("/etc/fstab", []byte(microvmFstab)); err != nil {
+		log.Fatalln(err.Errmsg)
+	}
+	enableSerialGetty(g, "ttyS0")
+	generalizeGuest(g, config.Generalize)
+
+	if kernel == "" {
+		bzImage, err := ioutil.TempFile(dir, ".d2b-vmlinuz*")
+		if err != nil {
+			log.Fatal(err)
+		}
+		bzImage.Close()
+		defer os.Remove(bzImage.Name())
+		if err := g.Download("/vmlinuz", bzImage.Name()); err != nil {
+			log.Fatalf("Fail to copy the kernel %s\n", err.Errmsg)
+		}
+		kernel = bzImage.Name()
+	}
+
+	if err := g.Umount_all(); err != nil {
+		log.Fatalln(err.Errmsg)
+	}
+	if err := g.Shutdown(); err != nil {
+		panic(fmt.Sprintf("write to disk failed: %s", err))
+	}
+
+	image, err := ioutil.ReadFile(kernel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	vmlinux, err := extractVmlinux(image)
+	if err != nil {
+		log.Fatalf("Fail to extract vmlinux from %s: %s\n", kernel, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, microvmKernel), vmlinux, 0644); err != nil {
+		log.Fatal(err)
+	}
+
+	data, err := json.MarshalIndent(newFirecrackerConfig(vm), "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, microvmConfig), append(data, '\n'), 0644); err != nil {
+		log.Fatal(err)
+	}
+	for _, file := range []string{microvmKernel, microvmRootfs, microvmConfig} {
+		log.Printf("[Info]   %s\n", filepath.Join(dir, file))
+	}
+}
+
+// enableSerialGetty start a login on the serial console tty
+func enableSerialGetty(g *guestfs.Guestfs, tty string) {
+	wants := "/etc/systemd/system/getty.target.wants"
+	if err := g.Mkdir_p(wants); err != nil {
+		log.Fatalln(err.Errmsg)
+	}
+	unit := "serial-getty@" + tty + ".service"
+	if err := g.Ln_sf("/lib/systemd/system/serial-getty@.service", filepath.Join(wants, unit)); err != nil {
+		log.Fatalln(err.Errmsg)
+	}
+}
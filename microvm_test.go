@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// fakeBzImage return a bzImage with one setup sector and payload
+func fakeBzImage(payload []byte) []byte {
+	image := make([]byte, 2*512)
+	image[bzImageSetupSects] = 1
+	copy(image[bzImageHeaderMagic:], "HdrS")
+	binary.LittleEndian.PutUint32(image[bzImagePayloadOffset:], 16)
+	binary.LittleEndian.PutUint32(image[bzImagePayloadLength:], uint32(len(payload)))
+	image = append(image, make([]byte, 16)...)
+	image = append(image, payload...)
+	// the uncompressed size
+	return append(image, 0, 0, 1, 0)
+}
+
+func TestExtractVmlinux(t *testing.T) {
+	vmlinux := append(append([]byte{}, elfMagic...), bytes.Repeat([]byte("kernel"), 100)...)
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(vmlinux)
+	w.Close()
+	out, err := extractVmlinux(fakeBzImage(append(gz.Bytes(), 0, 0, 1, 0)))
+	if err != nil || !bytes.Equal(out, vmlinux) {
+		t.Errorf("gzip: unexpected vmlinux %v", err)
+	}
+
+	// 10 literals "\x7fELFkernel", then a match at offset 6 of 594 bytes
+	// repeating "kernel", 15+255+255+65+4, and the empty last sequence
+	block := []byte{0xaf, 0x7f, 'E', 'L', 'F', 'k', 'e', 'r', 'n', 'e', 'l', 0x06, 0x00, 255, 255, 65, 0x00}
+	lz4 := append([]byte{}, lz4LegacyMagic...)
+	size := make([]byte, 4)
+	binary.LittleEndian.PutUint32(size, uint32(len(block)))
+	lz4 = append(append(lz4, size...), block...)
+	out, err = extractVmlinux(fakeBzImage(lz4))
+	if err != nil || !bytes.Equal(out, vmlinux) {
+		t.Errorf("lz4: unexpected vmlinux %v %q", err, out)
+	}
+
+	if _, err := extractVmlinux(fakeBzImage([]byte{0xfd, '7', 'z', 'X', 'Z', 0x00, 1, 2})); err == nil || !strings.Contains(err.Error(), "xz") {
+		t.Errorf("expected error for xz, got %v", err)
+	}
+	if out, err := extractVmlinux(vmlinux); err != nil || !bytes.Equal(out, vmlinux) {
+		t.Errorf("vmlinux should be kept as it is")
+	}
+}
+
+func TestFirecrackerConfig(t *testing.T) {
+	c := newFirecrackerConfig(&virtualMachine{CPUs: 2, Memory: 1024, NICs: 1})
+	if c.BootSource.KernelImagePath != microvmKernel || !c.Drives[0].IsRootDevice || c.MachineConfig.MemSizeMib != 1024 {
+		t.Errorf("unexpected config %#v", c)
+	}
+	if len(c.NetworkInterfaces) != 1 || c.NetworkInterfaces[0].HostDevName != "tap0" {
+		t.Errorf("unexpected nics %#v", c.NetworkInterfaces)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"github.com/binchenx/guestfs"
+)
+
+// netboot artefacts: the kernel, the initrd and root, with sample ipxe and
+// pxelinux configs. The disk is not partitioned, root is built on a scratch
+// filesystem and packed as a squashfs fetched over http by an initramfs
+// script, or as a cpio unpacked by the kernel as its initramfs.
+
+const OutputFormatPxe = "pxe"
+
+const (
+	NetbootRootSquashfs = "squashfs"
+	NetbootRootCpio     = "cpio"
+)
+
+const (
+	netbootKernel   = "vmlinuz"
+	netbootInitrd   = "initrd.img"
+	netbootSquashfs = "filesystem.squashfs"
+	netbootCpio     = "rootfs.cpio.gz"
+)
+
+// Netboot is how the artefacts are served
+type Netboot struct {
+	// URL the artefacts are served from
+	URL string
+	// Root is NetbootRootSquashfs or NetbootRootCpio
+	Root string
+}
+
+func (n *Netboot) validate() error {
+	if n.Root != NetbootRootSquashfs && n.Root != NetbootRootCpio {
+		return fmt.Errorf("unsupported netboot root %s, should be squashfs or cpio", n.Root)
+	}
+	return nil
+}
+
+// files return the artefacts booting the machine
+func (n *Netboot) files() []string {
+	if n.Root == NetbootRootCpio {
+		return []string{netbootKernel, netbootCpio}
+	}
+	return []string{netbootKernel, netbootInitrd, netbootSquashfs}
+}
+
+var ipxeTemplate = template.Must(template.New("ipxe").Parse(`#!ipxe
+dhcp
+set base-url {{ .URL }}
+{{- if eq .Root "cpio" }}
+kernel ${base-url}/` + netbootKernel + ` initrd=` + netbootCpio + ` rdinit=/sbin/init {{ .Cmdline }}
+initrd ${base-url}/` + netbootCpio + `
+{{- else }}
+kernel ${base-url}/` + netbootKernel + ` initrd=` + netbootInitrd + ` boot=d2b-netboot d2b.fetch=${base-url}/` + netbootSquashfs + ` ip=dhcp {{ .Cmdline }}
+initrd ${base-url}/` + netbootInitrd + `
+{{- end }}
+boot
+`))
+
+var pxelinuxTemplate = template.Must(template.New("pxelinux").Parse(`DEFAULT d2b
+LABEL d2b
+  KERNEL ` + netbootKernel + `
+{{- if eq .Root "cpio" }}
+  INITRD ` + netbootCpio + `
+  APPEND rdinit=/sbin/init {{ .Cmdline }}
+{{- else }}
+  INITRD ` + netbootInitrd + `
+  APPEND boot=d2b-netboot d2b.fetch={{ .URL }}/` + netbootSquashfs + ` ip=dhcp {{ .Cmdline }}
+{{- end }}
+`))
+
+// initramfs-tools boot script selected with boot=d2b-netboot, see
+// initramfs-tools(7). The squashfs is kept in memory and root is made writable
+// with a tmpfs overlay.
+const netbootInitramfsScript = `# root fetched over http
+mountroot()
+{
+	for x in $(cat /proc/cmdline); do
+		case $x in
+		d2b.fetch=*) FETCH=${x#*=} ;;
+		esac
+	done
+	[ -n "$FETCH" ] || panic "netboot: d2b.fetch is not set"
+
+	configure_networking
+
+	# /run is moved to the real root by init, so are the mounts below it
+	mkdir -p /run/d2b-netboot
+	mount -t tmpfs tmpfs /run/d2b-netboot
+	mkdir -p /run/d2b-netboot/lower /run/d2b-netboot/upper /run/d2b-netboot/work
+	wget -O /run/d2b-netboot/root.squashfs "$FETCH" || panic "netboot: fail to fetch $FETCH"
+	mount -t squashfs -o loop,ro /run/d2b-netboot/root.squashfs /run/d2b-netboot/lower ||
+		panic "netboot: fail to mount $FETCH"
+	mount -t overlay overlay \
+		-o lowerdir=/run/d2b-netboot/lower,upperdir=/run/d2b-netboot/upper,workdir=/run/d2b-netboot/work \
+		"${rootmnt}" || panic "netboot: fail to mount root"
+}
+`
+
+const netbootInitramfsHook = `#!/bin/sh
+PREREQ=""
+prereqs() { echo "$PREREQ"; }
+case $1 in prereqs) prereqs; exit 0;; esac
+
+. /usr/share/initramfs-tools/hook-functions
+manual_add_modules loop squashfs overlay
+`
+
+// busybox provides wget
+const netbootInitramfsConf = "BUSYBOX=y\n"
+
+// install the initramfs script mounting the squashfs root
+func installNetbootInitramfs(g *guestfs.Guestfs) {
+	files := map[string]string{
+		"/etc/initramfs-tools/scripts/d2b-netboot": netbootInitramfsScript,
+		"/etc/initramfs-tools/hooks/d2b-netboot":   netbootInitramfsHook,
+		"/etc/initramfs-tools/conf.d/d2b-netboot":  netbootInitramfsConf,
+	}
+	for file, content := range files {
+		if err := g.Mkdir_p(filepath.Dir(file)); err != nil {
+			log.Fatalln(err.Errmsg)
+		}
+		if err := g.Write(file, []byte(content)); err != nil {
+			log.Fatalln(err.Errmsg)
+		}
+		if err := g.Chmod(0755, file); err != nil {
+			log.Fatalln(err.Errmsg)
+		}
+	}
+	log.Println("[Info] Install netboot initramfs scripts")
+}
+
+// configs return the sample boot configs by file name
+func (n *Netboot) configs(cmdline string) (map[string]string, error) {
+	data := map[string]string{
+		"URL":     n.URL,
+		"Root":    n.Root,
+		"Cmdline": cmdline,
+	}
+	configs := map[string]string{}
+	for file, t := range map[string]*template.Template{
+		"boot.ipxe":            ipxeTemplate,
+		"pxelinux.cfg/default": pxelinuxTemplate,
+	} {
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		configs[file] = buf.String()
+	}
+	return configs, nil
+}
+
+// CreateNetbootArtefacts write the netboot artefacts of contents to dir, root
+// is built on a scratch filesystem of size bytes
+func CreateNetbootArtefacts(dir string, size int64, contents *[]Content, config *Config, netboot Netboot, debug bool) {
+	log.Printf("[Info] Create netboot artefacts in %s\n", dir)
+	if err := netboot.validate(); err != nil {
+		log.Fatal(err)
+	}
+	target, err := config.target()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "pxelinux.cfg"), 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	scratch := filepath.Join(dir, ".d2b-root.raw")
+	defer os.Remove(scratch)
+	g := launchScratchRoot(scratch, size, "", config, debug)
+	defer g.Close()
+	populateScratchRoot(g, contents, config, target)
+	if netboot.Root == NetbootRootSquashfs {
+		installNetbootInitramfs(g)
+		if out, err := g.Command([]string{"update-initramfs", "-u", "-k", "all"}); err != nil {
+			log.Fatalf("Fail to update initramfs %s %s\n", out, err.Errmsg)
+		}
+	}
+	generalizeGuest(g, config.Generalize)
+
+	log.Println("[Info] Export netboot artefacts")
+	if err := g.Download("/vmlinuz", filepath.Join(dir, netbootKernel)); err != nil {
+		log.Fatalf("Fail to copy the kernel %s\n", err.Errmsg)
+	}
+	if netboot.Root == NetbootRootSquashfs {
+		if err := g.Download("/initrd.img", filepath.Join(dir, netbootInitrd)); err != nil {
+			log.Fatalf("Fail to copy the initrd %s\n", err.Errmsg)
+		}
+		err := g.Mksquashfs("/", filepath.Join(dir, netbootSquashfs), &guestfs.OptargsMksquashfs{
+			Compress_is_set: true,
+			Compress:        "xz",
+		})
+		if err != nil {
+			log.Fatalf("Fail to create squashfs %s\n", err.Errmsg)
+		}
+	} else {
+		exportCpioRoot(g, filepath.Join(dir, netbootCpio))
+	}
+
+	if err := g.Umount_all(); err != nil {
+		log.Fatalln(err.Errmsg)
+	}
+	if err := g.Shutdown(); err != nil {
+		panic(fmt.Sprintf("write to disk failed: %s", err))
+	}
+
+	configs, err := netboot.configs(target.KernelCmdline)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for file, content := range configs {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(content), 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, file := range netboot.files() {
+		log.Printf("[Info]   %s\n", filepath.Join(dir, file))
+	}
+}
+
+// export root as a gzipped newc cpio, the kernel runs /sbin/init from it
+func exportCpioRoot(g *guestfs.Guestfs, file string) {
+	cpio, err := ioutil.TempFile(filepath.Dir(file), ".d2b-root*.cpio")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.Remove(cpio.Name())
+	defer cpio.Close()
+
+	if err := g.Cpio_out("/", cpio.Name(), &guestfs.OptargsCpio_out{
+		Format_is_set: true,
+		Format:        "newc",
+	}); err != nil {
+		log.Fatalf("Fail to create cpio %s\n", err.Errmsg)
+	}
+
+	out, err := os.Create(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer out.Close()
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, cpio); err != nil {
+		log.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNetbootConfigs(t *testing.T) {
+	n := Netboot{URL: "http://10.0.0.1/d2b", Root: NetbootRootSquashfs}
+	if err := n.validate(); err != nil {
+		t.Fatal(err)
+	}
+	configs, err := n.configs("console=ttyS0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipxe := configs["boot.ipxe"]; !strings.Contains(ipxe, "boot=d2b-netboot d2b.fetch=${base-url}/filesystem.squashfs ip=dhcp console=ttyS0\n") ||
+		!strings.Contains(ipxe, "set base-url http://10.0.0.1/d2b\n") {
+		t.Errorf("unexpected boot.ipxe\n%s", ipxe)
+	}
+	if pxelinux := configs["pxelinux.cfg/default"]; !strings.Contains(pxelinux, "d2b.fetch=http://10.0.0.1/d2b/filesystem.squashfs") {
+		t.Errorf("unexpected pxelinux config\n%s", pxelinux)
+	}
+
+	n.Root = NetbootRootCpio
+	configs, err = n.configs("console=ttyS0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pxelinux := configs["pxelinux.cfg/default"]; !strings.Contains(pxelinux, "INITRD rootfs.cpio.gz\n  APPEND rdinit=/sbin/init console=ttyS0\n") {
+		t.Errorf("unexpected pxelinux config\n%s", pxelinux)
+	}
+	if files := n.files(); len(files) != 2 || files[1] != netbootCpio {
+		t.Errorf("unexpected files %v", files)
+	}
+
+	n.Root = "nfs"
+	if err := n.validate(); err == nil {
+		t.Errorf("expected error for nfs root")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// output formats of the disk, the disk is always built raw then converted
+const (
+	OutputFormatRaw   = "raw"
+	OutputFormatQcow2 = "qcow2"
+	// fixed size vhd, as required by azure
+	OutputFormatVhd  = "vhd"
+	OutputFormatVmdk = "vmdk"
+	// disk.raw in a gzipped tar, as imported by gce
+	OutputFormatGce = "gce"
+	// ovf appliance with a streamOptimized vmdk, for vmware and virtualbox
+	OutputFormatOva = "ova"
+)
+
+// qemu-img arguments converting to the format
+var outputFormatArgs = map[string][]string{
+	OutputFormatQcow2: {"-O", "qcow2", "-c"},
+	OutputFormatVhd:   {"-O", "vpc", "-o", "subformat=fixed,force_size"},
+	OutputFormatVmdk:  {"-O", "vmdk", "-o", "subformat=streamOptimized"},
+}
+
+// packers of the formats which are more than a disk image, the raw disk is
+// packed to out with the description of the virtual machine
+var outputPackers = map[string]func(raw string, out string, vm *virtualMachine) error{
+	OutputFormatGce:               packGceImage,
+	OutputFormatOva:               packOva,
+	OutputFormatVagrantLibvirt:    packVagrantLibvirt,
+	OutputFormatVagrantVirtualbox: packVagrantVirtualbox,
+	OutputFormatIso:               packIso,
+}
+
+// outputPackages are the packages the format needs in the image
+var outputPackages = map[string][]string{
+	OutputFormatIso: {"casper"},
+	OutputFormatPxe: {"busybox-initramfs"},
+}
+
+// gce only imports a disk named disk.raw
+const gceDiskName = "disk.raw"
+
+func validateOutputFormat(format string) error {
+	_, converted := outputFormatArgs[format]
+	_, packed := outputPackers[format]
+	// the pxe and microvm artefacts are not made from a disk
+	if !converted && !packed && format != OutputFormatRaw && format != OutputFormatPxe && format != OutputFormatMicrovm {
+		return fmt.Errorf("unsupported output format %s", format)
+	}
+	return nil
+}
+
+// rawDiskName return where the raw disk is built before being converted to out
+func rawDiskName(out string, format string) string {
+	switch format {
+	case OutputFormatRaw:
+		return out
+	case OutputFormatGce:
+		return filepath.Join(out+".d", gceDiskName)
+	}
+	return out + ".raw"
+}
+
+// prepareRawDisk create the directory of the raw disk and return its name
+func prepareRawDisk(out string, format string) (string, error) {
+	raw := rawDiskName(out, format)
+	if err := os.MkdirAll(filepath.Dir(raw), 0755); err != nil {
+		return "", err
+	}
+	return raw, nil
+}
+
+// convertDisk convert the raw disk to out in format, the raw disk is removed
+func convertDisk(raw string, out string, format string, vm *virtualMachine) error {
+	if format == OutputFormatRaw {
+		return nil
+	}
+	if err := validateOutputFormat(format); err != nil {
+		return err
+	}
+
+	log.Printf("[Info] Convert %s to %s %s\n", raw, format, out)
+	if pack, ok := outputPackers[format]; ok {
+		return pack(raw, out, vm)
+	}
+
+	if err := qemuImgConvert(raw, out, format); err != nil {
+		return err
+	}
+	return os.Remove(raw)
+}
+
+func qemuImgConvert(raw string, out string, format string) error {
+	args := append([]string{"convert", "-f", "raw"}, outputFormatArgs[format]...)
+	args = append(args, raw, out)
+	cmd := exec.Command("qemu-img", args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("qemu-img %s: %s", err, output)
+	}
+	return nil
+}
+
+// packGceImage pack the raw disk as gce expects it, keeping it sparse, see
+// https://cloud.google.com/compute/docs/import/import-existing-image
+func packGceImage(raw string, out string, vm *virtualMachine) error {
+	if filepath.Base(raw) != gceDiskName {
+		return fmt.Errorf("gce disk should be named %s, not %s", gceDiskName, raw)
+	}
+	absOut, err := filepath.Abs(out)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("tar", "--format=oldgnu", "-Sczf", absOut, gceDiskName)
+	cmd.Dir = filepath.Dir(raw)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("tar %s: %s", err, output)
+	}
+	return os.RemoveAll(filepath.Dir(raw))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRawDiskName(t *testing.T) {
+	if name := rawDiskName("disk.img", OutputFormatRaw); name != "disk.img" {
+		t.Errorf("unexpected raw disk %s", name)
+	}
+	if name := rawDiskName("disk.qcow2", OutputFormatQcow2); name != "disk.qcow2.raw" {
+		t.Errorf("unexpected raw disk %s", name)
+	}
+	if err := validateOutputFormat("vdi"); err == nil {
+		t.Errorf("expected error for unknown format")
+	}
+}
+
+func TestPackGceImage(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "image.tar.gz")
+	raw, err := prepareRawDisk(out, OutputFormatGce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(1024 * 1024); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if err := convertDisk(raw, out, OutputFormatGce, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Dir(raw)); !os.IsNotExist(err) {
+		t.Errorf("raw disk should be removed")
+	}
+
+	a, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	z, err := gzip.NewReader(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := tar.NewReader(z).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Name != gceDiskName || h.Size != 1024*1024 {
+		t.Errorf("unexpected archive entry %s %d", h.Name, h.Size)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+// ova appliance: the ovf descriptor, its manifest and a streamOptimized vmdk in
+// a tar, see https://www.dmtf.org/standards/ovf
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// rasd elements of an item are in alphabetical order as the schema requires
+var ovfTemplate = template.Must(template.New("ovf").Funcs(template.FuncMap{"xml": xmlEscape}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<Envelope xmlns="http://schemas.dmtf.org/ovf/envelope/1" xmlns:ovf="http://schemas.dmtf.org/ovf/envelope/1" xmlns:rasd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_ResourceAllocationSettingData" xmlns:vssd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_VirtualSystemSettingData" xmlns:vmw="http://www.vmware.com/schema/ovf" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+  <References>
+    <File ovf:href="{{ xml .Disk }}" ovf:id="file1" ovf:size="{{ .DiskFileSize }}"/>
+  </References>
+  <DiskSection>
+    <Info>Virtual disk information</Info>
+    <Disk ovf:capacity="{{ .VM.DiskSize }}" ovf:capacityAllocationUnits="byte" ovf:diskId="vmdisk1" ovf:fileRef="file1" ovf:format="http://www.vmware.com/interfaces/specifications/vmdk.html#streamOptimized"/>
+  </DiskSection>
+  <NetworkSection>
+    <Info>The list of logical networks</Info>
+    <Network ovf:name="nat">
+      <Description>The nat network</Description>
+    </Network>
+  </NetworkSection>
+  <VirtualSystem ovf:id="{{ xml .VM.Name }}">
+    <Info>A virtual machine</Info>
+    <Name>{{ xml .VM.Name }}</Name>
+    <OperatingSystemSection ovf:id="94" vmw:osType="ubuntu64Guest">
+      <Info>The kind of installed guest operating system</Info>
+    </OperatingSystemSection>
+    <VirtualHardwareSection>
+      <Info>Virtual hardware requirements</Info>
+      <System>
+        <vssd:ElementName>Virtual Hardware Family</vssd:ElementName>
+        <vssd:InstanceID>0</vssd:InstanceID>
+        <vssd:VirtualSystemIdentifier>{{ xml .VM.Name }}</vssd:VirtualSystemIdentifier>
+        <vssd:VirtualSystemType>vmx-10 virtualbox-2.2</vssd:VirtualSystemType>
+      </System>
+      <Item>
+        <rasd:AllocationUnits>hertz * 10^6</rasd:AllocationUnits>
+        <rasd:Description>Number of Virtual CPUs</rasd:Description>
+        <rasd:ElementName>{{ .VM.CPUs }} virtual CPU(s)</rasd:ElementName>
+        <rasd:InstanceID>1</rasd:InstanceID>
+        <rasd:ResourceType>3</rasd:ResourceType>
+        <rasd:VirtualQuantity>{{ .VM.CPUs }}</rasd:VirtualQuantity>
+      </Item>
+      <Item>
+        <rasd:AllocationUnits>byte * 2^20</rasd:AllocationUnits>
+        <rasd:Description>Memory Size</rasd:Description>
+        <rasd:ElementName>{{ .VM.Memory }}MB of memory</rasd:ElementName>
+        <rasd:InstanceID>2</rasd:InstanceID>
+        <rasd:ResourceType>4</rasd:ResourceType>
+        <rasd:VirtualQuantity>{{ .VM.Memory }}</rasd:VirtualQuantity>
+      </Item>
+      <Item>
+        <rasd:Address>0</rasd:Address>
+        <rasd:Description>SCSI Controller</rasd:Description>
+        <rasd:ElementName>SCSI Controller 0</rasd:ElementName>
+        <rasd:InstanceID>3</rasd:InstanceID>
+        <rasd:ResourceSubType>lsilogic</rasd:ResourceSubType>
+        <rasd:ResourceType>6</rasd:ResourceType>
+      </Item>
+      <Item>
+        <rasd:AddressOnParent>0</rasd:AddressOnParent>
+        <rasd:ElementName>Hard Disk 1</rasd:ElementName>
+        <rasd:HostResource>ovf:/disk/vmdisk1</rasd:HostResource>
+        <rasd:InstanceID>4</rasd:InstanceID>
+        <rasd:Parent>3</rasd:Parent>
+        <rasd:ResourceType>17</rasd:ResourceType>
+      </Item>
+{{- range $i, $id := .NICs }}
+      <Item>
+        <rasd:AddressOnParent>{{ $i }}</rasd:AddressOnParent>
+        <rasd:AutomaticAllocation>true</rasd:AutomaticAllocation>
+        <rasd:Connection>nat</rasd:Connection>
+        <rasd:ElementName>Ethernet adapter {{ $i }}</rasd:ElementName>
+        <rasd:InstanceID>{{ $id }}</rasd:InstanceID>
+        <rasd:ResourceSubType>E1000</rasd:ResourceSubType>
+        <rasd:ResourceType>10</rasd:ResourceType>
+      </Item>
+{{- end }}
+      <vmw:Config ovf:required="false" vmw:key="firmware" vmw:value="{{ .VM.Firmware }}"/>
+    </VirtualHardwareSection>
+  </VirtualSystem>
+</Envelope>
+`))
+
+// ovfDescriptor return the ovf of vm with the vmdk disk of diskFileSize bytes
+func ovfDescriptor(vm *virtualMachine, disk string, diskFileSize int64) (string, error) {
+	// the nics follow the 4 items above
+	var nics []int
+	for i := 0; i < vm.NICs; i++ {
+		nics = append(nics, 5+i)
+	}
+
+	var buf bytes.Buffer
+	err := ovfTemplate.Execute(&buf, map[string]interface{}{
+		"VM":           vm,
+		"Disk":         disk,
+		"DiskFileSize": diskFileSize,
+		"NICs":         nics,
+	})
+	return buf.String(), err
+}
+
+func sha256File(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// packOva convert the raw disk to a vmdk and pack it with the ovf of vm
+func packOva(raw string, out string, vm *virtualMachine) error {
+	dir, err := ioutil.TempDir(filepath.Dir(out), "d2b-ova")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	vmdk := vm.Name + "-disk1.vmdk"
+	if err := qemuImgConvert(raw, filepath.Join(dir, vmdk), OutputFormatVmdk); err != nil {
+		return err
+	}
+	info, err := os.Stat(filepath.Join(dir, vmdk))
+	if err != nil {
+		return err
+	}
+	ovf, err := ovfDescriptor(vm, vmdk, info.Size())
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, vm.Name+".ovf"), []byte(ovf), 0644); err != nil {
+		return err
+	}
+
+	if err := writeOva(dir, out, vm.Name+".ovf", vmdk); err != nil {
+		return err
+	}
+	return os.Remove(raw)
+}
+
+// writeOva write the ovf, the manifest and the disks of dir to the ova out,
+// the ovf must be first
+func writeOva(dir string, out string, ovf string, disks ...string) error {
+	files := append([]string{ovf}, disks...)
+	var manifest bytes.Buffer
+	for _, name := range files {
+		sum, err := sha256File(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&manifest, "SHA256(%s)= %s\n", name, sum)
+	}
+	mf := ovf[:len(ovf)-len(filepath.Ext(ovf))] + ".mf"
+	if err := ioutil.WriteFile(filepath.Join(dir, mf), manifest.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, name := range append([]string{ovf, mf}, disks...) {
+		if err := addFileToTar(tw, filepath.Join(dir, name), name); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func addFileToTar(tw *tar.Writer, file string, name string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Format:  tar.FormatUSTAR,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOvfDescriptor(t *testing.T) {
+	const GB = 1024 * 1024 * 1024
+	layout := NewDefaultLayout()
+	vm := newVirtualMachine("out/myos.ova", &VM{Memory: 4096, NICs: 2}, layout, Disk{Size: 2 * GB}, defaultKernelCmdline)
+	if vm.Name != "myos" || vm.CPUs != 2 || vm.Firmware != FirmwareBios {
+		t.Errorf("unexpected vm %#v", vm)
+	}
+
+	ovf, err := ovfDescriptor(vm, "myos-disk1.vmdk", 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := xml.Unmarshal([]byte(ovf), new(interface{})); err != nil {
+		t.Errorf("invalid ovf %s", err)
+	}
+	for _, s := range []string{
+		`ovf:href="myos-disk1.vmdk" ovf:id="file1" ovf:size="1234"`,
+		`ovf:capacity="2147483648"`,
+		`<rasd:VirtualQuantity>4096</rasd:VirtualQuantity>`,
+		`<rasd:InstanceID>6</rasd:InstanceID>`,
+		`vmw:key="firmware" vmw:value="bios"`,
+	} {
+		if !strings.Contains(ovf, s) {
+			t.Errorf("missing %s in\n%s", s, ovf)
+		}
+	}
+}
+
+func TestWriteOva(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{"myos.ovf": "<Envelope/>", "myos-disk1.vmdk": "disk"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := filepath.Join(dir, "myos.ova")
+	if err := writeOva(dir, out, "myos.ovf", "myos-disk1.vmdk"); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var names []string
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, h.Name)
+		if h.Name == "myos.mf" {
+			mf, _ := ioutil.ReadAll(tr)
+			// sha256 of "disk"
+			if !strings.HasPrefix(string(mf), "SHA256(myos.ovf)= ") ||
+				!strings.Contains(string(mf), "SHA256(myos-disk1.vmdk)= 1044dec7206e8d7c9fbb4ae8f766668406d2567fc7fc1a160a9d4700fcf8f8e9\n") {
+				t.Errorf("unexpected manifest %s", mf)
+			}
+		}
+	}
+	if strings.Join(names, " ") != "myos.ovf myos.mf myos-disk1.vmdk" {
+		t.Errorf("unexpected ova files %v", names)
+	}
+}
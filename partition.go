@@ -1,28 +1,117 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
 
 // disk parititions definition, generation and validation
 type DiskLayout struct {
 	// support gpt Only
-	ParitionType string
-	Partitions   []Partition
+	ParitionType string      `yaml:"partitionType,omitempty"`
+	Partitions   []Partition `yaml:"partitions,omitempty"`
+	// VolumeGroups are LVM volume groups created on top of the partitions
+	VolumeGroups []VolumeGroup `yaml:"volumeGroups,omitempty"`
+	// Verity make root read-only and protected by dm-verity
+	Verity *Verity `yaml:"verity,omitempty"`
+	// AB use two root partitions for atomic updates
+	AB *ABScheme `yaml:"ab,omitempty"`
 }
 type Partition struct {
 	// TODO: rename to Num
-	ID int
+	ID int `yaml:"id"`
 	// Start is the start sector of the partition
-	Start int64
+	Start int64 `yaml:"start"`
 	// End is the end sector of the partition
-	End        int64
-	Name       string
-	GptType    string
-	Fstype     string
-	FsLabel    string
-	MountPoint string
-	FsMountOps string
+	End        int64  `yaml:"end"`
+	Name       string `yaml:"name"`
+	GptType    string `yaml:"gptType,omitempty"`
+	Fstype     string `yaml:"fstype,omitempty"`
+	FsLabel    string `yaml:"fsLabel,omitempty"`
+	MountPoint string `yaml:"mountPoint,omitempty"`
+	FsMountOps string `yaml:"fsMountOps,omitempty"`
+	// Encrypted create a LUKS container on the partition and the filesystem (or
+	// LVM physical volume) inside it, only EncryptionLuks2 is supported
+	Encrypted string `yaml:"encrypted,omitempty"`
+	// KeyFile is a host file holding the key of the LUKS container, it is
+	// installed in the image to unlock non-root partitions at boot
+	KeyFile string `yaml:"keyFile,omitempty"`
+	// Passphrase of the LUKS container if KeyFile is not set, it is asked at boot
+	Passphrase  string       `yaml:"passphrase,omitempty"`
+	MkfsOptions *MkfsOptions `yaml:"mkfsOptions,omitempty"`
+	// Subvolumes are the btrfs subvolumes to create and mount, a filesystem
+	// with subvolumes has no MountPoint itself
+	Subvolumes []Subvolume `yaml:"subvolumes,omitempty"`
+}
+
+// MkfsOptions tune the filesystem created on a partition or a logical volume
+type MkfsOptions struct {
+	// BlockSize in bytes
+	BlockSize int `yaml:"blockSize,omitempty"`
+	// InodeRatio is the bytes per inode, ext2/3/4 only
+	InodeRatio int64 `yaml:"inodeRatio,omitempty"`
+	// Features is passed to mke2fs -O, ext2/3/4 only
+	Features string `yaml:"features,omitempty"`
+	// ReservedBlocks is the percentage of blocks reserved for root, ext2/3/4 only
+	ReservedBlocks *int `yaml:"reservedBlocks,omitempty"`
+}
+
+type Subvolume struct {
+	Name       string `yaml:"name"`
+	MountPoint string `yaml:"mountPoint,omitempty"`
+	FsMountOps string `yaml:"fsMountOps,omitempty"`
+}
+
+// supported filesystems
+const (
+	FstypeExt2  = "ext2"
+	FstypeExt3  = "ext3"
+	FstypeExt4  = "ext4"
+	FstypeVfat  = "vfat"
+	FstypeXfs   = "xfs"
+	FstypeBtrfs = "btrfs"
+	FstypeF2fs  = "f2fs"
+)
+
+func isExtFs(fstype string) bool {
+	return fstype == FstypeExt2 || fstype == FstypeExt3 || fstype == FstypeExt4
+}
+
+const (
+	EncryptionLuks2 = "luks2"
+)
+
+// VolumeGroup is an LVM volume group using partitions as physical volumes
+type VolumeGroup struct {
+	Name string `yaml:"name"`
+	// PhysicalVolumes are the names of the partitions to use as physical volumes,
+	// these partitions must not have a Fstype
+	PhysicalVolumes []string        `yaml:"physicalVolumes"`
+	LogicalVolumes  []LogicalVolume `yaml:"logicalVolumes,omitempty"`
+}
+
+type LogicalVolume struct {
+	Name string `yaml:"name"`
+	// Size is the size of the volume with M or G suffix, e.g. 512M or 2G, or
+	// LVSizeRest to use the remaining space of the volume group. Space not
+	// allocated to any volume is left free in the group for lvextend.
+	Size        string       `yaml:"size"`
+	Fstype      string       `yaml:"fstype,omitempty"`
+	FsLabel     string       `yaml:"fsLabel,omitempty"`
+	MountPoint  string       `yaml:"mountPoint,omitempty"`
+	FsMountOps  string       `yaml:"fsMountOps,omitempty"`
+	MkfsOptions *MkfsOptions `yaml:"mkfsOptions,omitempty"`
+	Subvolumes  []Subvolume  `yaml:"subvolumes,omitempty"`
 }
 
+// LVSizeRest make a logical volume take the remaining space of the volume group
+const LVSizeRest = "rest"
+
 const (
 	PartitionTypeGpt = "gpt"
 )
@@ -59,7 +148,14 @@ func (d *DiskLayout) validate() error {
 		if p.Name == PartitionNameEFI {
 			has_boot = true
 		}
-		if p.Name == PartitionNameRoot {
+		if d.AB != nil && p.Name == d.AB.SlotA {
+			has_root = true
+		}
+	}
+	// root is found by its mount point, it can be a subvolume or live on a
+	// logical volume as well
+	for _, m := range d.mountables() {
+		if m.MountPoint == "/" {
 			has_root = true
 		}
 	}
@@ -72,10 +168,470 @@ func (d *DiskLayout) validate() error {
 		return fmt.Errorf("parition table missiong root partition")
 	}
 
+	for _, p := range d.Partitions {
+		if err := p.validateEncryption(); err != nil {
+			return err
+		}
+		// the initramfs asks the passphrase of root, the key file is not in it
+		if p.Encrypted != "" && p.KeyFile != "" && d.holdsRoot(&p) {
+			return fmt.Errorf("partition %s: root is unlocked with a passphrase at boot, keyFile is only for the other partitions", p.Name)
+		}
+		if err := validateFilesystem(p.Name, p.Fstype, p.FsLabel, p.MountPoint, p.MkfsOptions, p.Subvolumes); err != nil {
+			return err
+		}
+	}
+	for _, vg := range d.VolumeGroups {
+		for _, lv := range vg.LogicalVolumes {
+			if err := validateFilesystem(lv.Name, lv.Fstype, lv.FsLabel, lv.MountPoint, lv.MkfsOptions, lv.Subvolumes); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := d.validateVolumeGroups(); err != nil {
+		return err
+	}
+
+	if err := d.validateVerity(); err != nil {
+		return err
+	}
+
+	if err := d.validateAB(); err != nil {
+		return err
+	}
+
+	mountPoints := map[string]bool{}
+	for _, m := range d.mountables() {
+		if mountPoints[m.MountPoint] {
+			return fmt.Errorf("mount point %s is used more than once", m.MountPoint)
+		}
+		mountPoints[m.MountPoint] = true
+	}
+
 	// TODO: check partition overlap and make sure not occupy mbr and biosboot partitions
 	return nil
 }
 
+// validate the filesystem of partition or logical volume name
+func validateFilesystem(name, fstype, label, mountPoint string, opts *MkfsOptions, subvolumes []Subvolume) error {
+	switch fstype {
+	case "", FstypeExt2, FstypeExt3, FstypeExt4, FstypeVfat, FstypeBtrfs, FstypeF2fs:
+	case FstypeXfs:
+		if len(label) > 12 {
+			return fmt.Errorf("%s: xfs label %s is longer than 12 characters", name, label)
+		}
+	default:
+		return fmt.Errorf("%s: unsupported fstype %s", name, fstype)
+	}
+
+	if opts != nil {
+		if fstype == "" {
+			return fmt.Errorf("%s: mkfsOptions without fstype", name)
+		}
+		if !isExtFs(fstype) && (opts.InodeRatio != 0 || opts.Features != "" || opts.ReservedBlocks != nil) {
+			return fmt.Errorf("%s: inodeRatio, features and reservedBlocks are only supported by ext2/3/4", name)
+		}
+		// inodeRatio needs mke2fs which don't take a feature list
+		if opts.InodeRatio != 0 && opts.Features != "" {
+			return fmt.Errorf("%s: inodeRatio can not be used with features", name)
+		}
+		if opts.ReservedBlocks != nil && (*opts.ReservedBlocks < 0 || *opts.ReservedBlocks > 50) {
+			return fmt.Errorf("%s: reservedBlocks should be a percentage between 0 and 50", name)
+		}
+	}
+
+	if len(subvolumes) != 0 {
+		if fstype != FstypeBtrfs {
+			return fmt.Errorf("%s: subvolumes are only supported by btrfs", name)
+		}
+		if mountPoint != "" {
+			return fmt.Errorf("%s: mount the subvolumes instead of the btrfs filesystem", name)
+		}
+		for _, sv := range subvolumes {
+			if sv.Name == "" {
+				return fmt.Errorf("%s: subvolume without name", name)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *Partition) validateEncryption() error {
+	if p.Encrypted == "" {
+		return nil
+	}
+	if p.Encrypted != EncryptionLuks2 {
+		return fmt.Errorf("partition %s: unsupported encryption %s", p.Name, p.Encrypted)
+	}
+	if p.Name == PartitionNameEFI || p.Name == PartitionNameBiosboot {
+		return fmt.Errorf("partition %s can not be encrypted", p.Name)
+	}
+	if p.KeyFile == "" && p.Passphrase == "" {
+		return fmt.Errorf("partition %s: encrypted partition needs a keyFile or a passphrase", p.Name)
+	}
+	if p.KeyFile != "" && p.Passphrase != "" {
+		return fmt.Errorf("partition %s: keyFile and passphrase are exclusive", p.Name)
+	}
+	return nil
+}
+
+// luksName return the device mapper name of the opened LUKS container
+func (p *Partition) luksName() string {
+	return p.Name + "_crypt"
+}
+
+// luksKey return the key of the LUKS container
+func (p *Partition) luksKey() (string, error) {
+	if p.KeyFile == "" {
+		return p.Passphrase, nil
+	}
+
+	key, err := ioutil.ReadFile(p.KeyFile)
+	if err != nil {
+		return "", fmt.Errorf("partition %s: %s", p.Name, err)
+	}
+	return string(key), nil
+}
+
+func (d *DiskLayout) validateVolumeGroups() error {
+	partitions := map[string]Partition{}
+	for _, p := range d.Partitions {
+		partitions[p.Name] = p
+	}
+
+	usedPVs := map[string]bool{}
+	for _, vg := range d.VolumeGroups {
+		if vg.Name == "" {
+			return fmt.Errorf("volume group without name")
+		}
+		if len(vg.PhysicalVolumes) == 0 {
+			return fmt.Errorf("volume group %s has no physical volumes", vg.Name)
+		}
+		for _, pv := range vg.PhysicalVolumes {
+			p, ok := partitions[pv]
+			if !ok {
+				return fmt.Errorf("volume group %s: physical volume %s is not a partition", vg.Name, pv)
+			}
+			if p.Fstype != "" {
+				return fmt.Errorf("volume group %s: physical volume %s should not have a fstype", vg.Name, pv)
+			}
+			if usedPVs[pv] {
+				return fmt.Errorf("physical volume %s is used by more than one volume group", pv)
+			}
+			usedPVs[pv] = true
+		}
+
+		var rest int
+		lvNames := map[string]bool{}
+		for _, lv := range vg.LogicalVolumes {
+			if lv.Name == "" {
+				return fmt.Errorf("volume group %s has a logical volume without name", vg.Name)
+			}
+			if lvNames[lv.Name] {
+				return fmt.Errorf("volume group %s: logical volume %s defined twice", vg.Name, lv.Name)
+			}
+			lvNames[lv.Name] = true
+
+			if lv.Size == LVSizeRest {
+				rest++
+				continue
+			}
+			if _, err := lv.sizeMB(); err != nil {
+				return fmt.Errorf("volume group %s: %s", vg.Name, err)
+			}
+		}
+		if rest > 1 {
+			return fmt.Errorf("volume group %s: only one logical volume can use the %s of the space", vg.Name, LVSizeRest)
+		}
+	}
+
+	return nil
+}
+
+// sizeMB return the size of the logical volume in megabytes
+func (lv *LogicalVolume) sizeMB() (int, error) {
+	size := strings.ToUpper(strings.TrimSpace(lv.Size))
+	unit := 1
+	switch {
+	case strings.HasSuffix(size, "G"):
+		unit = 1024
+		size = strings.TrimSuffix(size, "G")
+	case strings.HasSuffix(size, "M"):
+		size = strings.TrimSuffix(size, "M")
+	default:
+		return 0, fmt.Errorf("logical volume %s: size %q should end with M or G", lv.Name, lv.Size)
+	}
+
+	n, err := strconv.Atoi(size)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("logical volume %s: invalid size %q", lv.Name, lv.Size)
+	}
+	return n * unit, nil
+}
+
+// device return the device path of the logical volume in volume group vg
+func (lv *LogicalVolume) device(vg string) string {
+	return "/dev/" + vg + "/" + lv.Name
+}
+
+// mountable is a filesystem declared in the layout, either on a partition, in
+// an encrypted partition or on a logical volume
+type mountable struct {
+	// Partition is the name of the partition holding the filesystem, empty if
+	// the filesystem is not directly on a partition
+	Partition string
+	// Device is the device path of the logical volume or the opened LUKS container
+	Device     string
+	Fstype     string
+	FsLabel    string
+	MountPoint string
+	FsMountOps string
+	// Options are the mount options needed to mount the filesystem, e.g. the
+	// btrfs subvolume
+	Options string
+}
+
+// appendMountables append m, or a mountable per subvolume, to ms
+func appendMountables(ms []mountable, m mountable, subvolumes []Subvolume) []mountable {
+	if len(subvolumes) == 0 {
+		if m.MountPoint != "" {
+			ms = append(ms, m)
+		}
+		return ms
+	}
+
+	for _, sv := range subvolumes {
+		if sv.MountPoint != "" {
+			svm := m
+			svm.MountPoint = sv.MountPoint
+			svm.FsMountOps = sv.FsMountOps
+			svm.Options = "subvol=" + sv.Name
+			ms = append(ms, svm)
+		}
+	}
+	return ms
+}
+
+// mountables return all the filesystems with a mount point, sorted by mount
+// point so that parents are mounted before their children
+func (d *DiskLayout) mountables() []mountable {
+	var ms []mountable
+	for _, p := range d.Partitions {
+		m := mountable{
+			Partition:  p.Name,
+			Fstype:     p.Fstype,
+			FsLabel:    p.FsLabel,
+			MountPoint: p.MountPoint,
+			FsMountOps: p.FsMountOps,
+		}
+		if p.Encrypted != "" {
+			m.Partition = ""
+			m.Device = "/dev/mapper/" + p.luksName()
+		}
+		ms = appendMountables(ms, m, p.Subvolumes)
+	}
+
+	for _, vg := range d.VolumeGroups {
+		for _, lv := range vg.LogicalVolumes {
+			ms = appendMountables(ms, mountable{
+				Device:     lv.device(vg.Name),
+				Fstype:     lv.Fstype,
+				FsLabel:    lv.FsLabel,
+				MountPoint: lv.MountPoint,
+				FsMountOps: lv.FsMountOps,
+			}, lv.Subvolumes)
+		}
+	}
+
+	sort.Slice(ms, func(i, j int) bool { return ms[i].MountPoint < ms[j].MountPoint })
+	return ms
+}
+
+// rootDevice return the root= used in the kernel cmdline
+func (d *DiskLayout) rootDevice() string {
+	if d.Verity != nil {
+		return "/dev/mapper/" + verityMapperName
+	}
+	for _, vg := range d.VolumeGroups {
+		for _, lv := range vg.LogicalVolumes {
+			if lv.MountPoint == "/" {
+				// initramfs only activates the root volume group when root is given as a
+				// /dev/mapper path
+				return "/dev/mapper/" + strings.ReplaceAll(vg.Name, "-", "--") + "-" + strings.ReplaceAll(lv.Name, "-", "--")
+			}
+		}
+	}
+	for _, m := range d.mountables() {
+		if m.MountPoint != "/" {
+			continue
+		}
+		if m.FsLabel != "" {
+			return "LABEL=" + m.FsLabel
+		}
+		if m.Partition != "" {
+			return "PARTLABEL=" + m.Partition
+		}
+	}
+	return "LABEL=ROOT"
+}
+
+// labelOf return the filesystem label mounted at mountPoint
+func (d *DiskLayout) labelOf(mountPoint string) string {
+	for _, m := range d.mountables() {
+		if m.MountPoint == mountPoint {
+			return m.FsLabel
+		}
+	}
+	return ""
+}
+
+// kernelCmdline return the additional kernel cmdline needed to mount root
+func (d *DiskLayout) kernelCmdline() string {
+	var cmdline []string
+	for _, m := range d.mountables() {
+		if m.MountPoint == "/" && m.Options != "" {
+			cmdline = append(cmdline, "rootflags="+m.Options)
+		}
+	}
+	if d.Verity != nil {
+		cmdline = append(cmdline, d.verityCmdline()...)
+	}
+	return strings.Join(cmdline, " ")
+}
+
+// fstab return the /etc/fstab entries for the filesystems in the layout
+func (d *DiskLayout) fstab() string {
+	var fstabEntries []string
+	for _, m := range d.mountables() {
+		// we don't mount boot partition, systemd is taking care of
+		if m.Fstype != "" && m.FsLabel != "BOOT" {
+			options := m.FsMountOps
+			if options == "" {
+				options = "defaults"
+			}
+			if m.Options != "" {
+				options = m.Options + "," + options
+			}
+			entry := fmt.Sprintf("LABEL=%s %s %s %s 0 %d", m.FsLabel, m.MountPoint, m.Fstype, options, m.fsckPass())
+			// verity root is read-only and the device is opened by the initramfs
+			if m.MountPoint == "/" && d.Verity != nil {
+				entry = fmt.Sprintf("%s / %s ro 0 0", d.rootDevice(), d.Verity.format())
+			}
+			fstabEntries = append(fstabEntries, entry)
+		}
+	}
+
+	return strings.Join(fstabEntries, "\n")
+}
+
+// fsckPass return the fstab pass number, only ext filesystems are checked at
+// boot, xfs, btrfs and f2fs are checked (if at all) by their own tools
+func (m *mountable) fsckPass() int {
+	if !isExtFs(m.Fstype) {
+		return 0
+	}
+	if m.MountPoint == "/" {
+		return 1
+	}
+	return 2
+}
+
+// luksKeyFile is where the key of an encrypted partition is installed in the image
+func luksKeyFile(p *Partition) string {
+	return "/etc/cryptsetup-keys.d/" + p.luksName() + ".key"
+}
+
+// holdsRoot tell if the root filesystem is on the partition, either directly
+// or through a logical volume
+func (d *DiskLayout) holdsRoot(p *Partition) bool {
+	if p.MountPoint == "/" {
+		return true
+	}
+	for _, vg := range d.VolumeGroups {
+		for _, pv := range vg.PhysicalVolumes {
+			if pv != p.Name {
+				continue
+			}
+			for _, lv := range vg.LogicalVolumes {
+				if lv.MountPoint == "/" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// crypttab return the /etc/crypttab entries for the encrypted partitions,
+// uuids map the partition names to the UUID of their LUKS container.
+// The container holding root is unlocked by the initramfs and ask for the
+// passphrase, the others use the key installed in the image.
+func (d *DiskLayout) crypttab(uuids map[string]string) string {
+	var entries []string
+	for i := range d.Partitions {
+		p := &d.Partitions[i]
+		if p.Encrypted == "" {
+			continue
+		}
+
+		key := "none"
+		options := "luks,discard"
+		if d.holdsRoot(p) {
+			options += ",initramfs"
+		} else if p.KeyFile != "" {
+			key = luksKeyFile(p)
+		}
+		entries = append(entries, fmt.Sprintf("%s UUID=%s %s %s", p.luksName(), uuids[p.Name], key, options))
+	}
+
+	return strings.Join(entries, "\n")
+}
+
+// guestTool is a binary the image must provide for the layout to boot
+type guestTool struct {
+	Binary  string
+	Package string
+}
+
+// requiredGuestTools return the tools the initramfs needs to mount the layout
+func (d *DiskLayout) requiredGuestTools() []guestTool {
+	var tools []guestTool
+	if len(d.VolumeGroups) != 0 {
+		tools = append(tools, guestTool{Binary: "lvm", Package: "lvm2"})
+	}
+	if d.hasEncryptedPartitions() {
+		tools = append(tools, guestTool{Binary: "cryptsetup", Package: "cryptsetup-initramfs"})
+	}
+
+	if d.Verity != nil {
+		tools = append(tools, guestTool{Binary: "veritysetup", Package: "cryptsetup-bin"})
+	}
+
+	fsTools := map[string]guestTool{
+		FstypeXfs:   {Binary: "xfs_repair", Package: "xfsprogs"},
+		FstypeBtrfs: {Binary: "btrfs", Package: "btrfs-progs"},
+		FstypeF2fs:  {Binary: "fsck.f2fs", Package: "f2fs-tools"},
+	}
+	seen := map[string]bool{}
+	for _, m := range d.mountables() {
+		if t, ok := fsTools[m.Fstype]; ok && !seen[m.Fstype] {
+			tools = append(tools, t)
+			seen[m.Fstype] = true
+		}
+	}
+	return tools
+}
+
+func (d *DiskLayout) hasEncryptedPartitions() bool {
+	for _, p := range d.Partitions {
+		if p.Encrypted != "" {
+			return true
+		}
+	}
+	return false
+}
+
 // the default layout is BIOS/GPT/EFI setup, with following partition table
 // mbr
 // bios boot parition: 1M, for grub to intall core.img
@@ -130,7 +686,26 @@ func NewDefaultLayout() *DiskLayout {
 	}
 }
 
-func parseDisklayout(file string) *DiskLayout {
-	// TODO:
-	return NewDefaultLayout()
+// layoutPresets are the built-in layouts
+var layoutPresets = map[string]func() *DiskLayout{
+	"default": NewDefaultLayout,
+	"ab":      NewABLayout,
+}
+
+func parseDisklayout(file string) (*DiskLayout, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var layout DiskLayout
+	if err := yaml.Unmarshal(data, &layout); err != nil {
+		return nil, err
+	}
+
+	if layout.ParitionType == "" {
+		layout.ParitionType = PartitionTypeGpt
+	}
+
+	return &layout, nil
 }
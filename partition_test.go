@@ -0,0 +1,217 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseLvmLayout(t *testing.T) {
+	layout, err := parseDisklayout("layouts/lvm.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := layout.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	ms := layout.mountables()
+	var mountPoints []string
+	for _, m := range ms {
+		mountPoints = append(mountPoints, m.MountPoint)
+	}
+	if got := strings.Join(mountPoints, " "); got != "/ /boot /var /var/log" {
+		t.Errorf("unexpected mount order %s", got)
+	}
+
+	if ms[2].Device != "/dev/vg0/var" {
+		t.Errorf("expected /var on /dev/vg0/var, got %s", ms[2].Device)
+	}
+
+	if !strings.Contains(layout.fstab(), "LABEL=LOG /var/log ext4") {
+		t.Errorf("missing /var/log in fstab:\n%s", layout.fstab())
+	}
+}
+
+func TestValidateVolumeGroups(t *testing.T) {
+	layout := NewDefaultLayout()
+	layout.VolumeGroups = []VolumeGroup{
+		{
+			Name:            "vg0",
+			PhysicalVolumes: []string{"var"},
+		},
+	}
+	if err := layout.validate(); err == nil {
+		t.Errorf("expected error for physical volume with fstype")
+	}
+
+	layout.Partitions[3].Fstype = ""
+	layout.Partitions[3].MountPoint = ""
+	layout.VolumeGroups[0].LogicalVolumes = []LogicalVolume{
+		{Name: "a", Size: LVSizeRest},
+		{Name: "b", Size: LVSizeRest},
+	}
+	if err := layout.validate(); err == nil {
+		t.Errorf("expected error for two logical volumes using the rest")
+	}
+
+	layout.VolumeGroups[0].LogicalVolumes = []LogicalVolume{
+		{Name: "root", Size: "1G", MountPoint: "/"},
+	}
+	if err := layout.validate(); err == nil {
+		t.Errorf("expected error for / mounted twice")
+	}
+
+	layout.Partitions[2].MountPoint = ""
+	if err := layout.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if root := layout.rootDevice(); root != "/dev/mapper/vg0-root" {
+		t.Errorf("unexpected root device %s", root)
+	}
+
+	// root is found by its mount point, not its name
+	layout.VolumeGroups[0].LogicalVolumes[0].Name = "rootlv"
+	if err := layout.validate(); err != nil {
+		t.Fatal(err)
+	}
+	layout.VolumeGroups[0].LogicalVolumes[0].MountPoint = "/srv"
+	if err := layout.validate(); err == nil {
+		t.Errorf("expected error for a layout without /")
+	}
+	layout.VolumeGroups[0].LogicalVolumes[0] = LogicalVolume{Name: "root", Size: "1G", MountPoint: "/"}
+}
+
+func TestCrypttab(t *testing.T) {
+	layout := NewDefaultLayout()
+	layout.Partitions[2].Encrypted = EncryptionLuks2
+	layout.Partitions[2].Passphrase = "secret"
+	layout.Partitions[3].Encrypted = EncryptionLuks2
+	layout.Partitions[3].KeyFile = "var.key"
+	if err := layout.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	crypttab := layout.crypttab(map[string]string{"root": "uuid-root", "var": "uuid-var"})
+	expected := "root_crypt UUID=uuid-root none luks,discard,initramfs\n" +
+		"var_crypt UUID=uuid-var /etc/cryptsetup-keys.d/var_crypt.key luks,discard"
+	if crypttab != expected {
+		t.Errorf("unexpected crypttab:\n%s", crypttab)
+	}
+
+	for _, m := range layout.mountables() {
+		if m.MountPoint == "/var" && m.Device != "/dev/mapper/var_crypt" {
+			t.Errorf("expected /var on the opened container, got %s", m.Device)
+		}
+	}
+
+	layout.Partitions[1].Encrypted = EncryptionLuks2
+	if err := layout.validate(); err == nil {
+		t.Errorf("expected error for encrypted efi partition")
+	}
+	layout.Partitions[1].Encrypted = ""
+
+	layout.Partitions[2].Passphrase = ""
+	layout.Partitions[2].KeyFile = "root.key"
+	if err := layout.validate(); err == nil {
+		t.Errorf("expected error for a root container with a key file")
+	}
+}
+
+func TestParseBtrfsXfsLayout(t *testing.T) {
+	layout, err := parseDisklayout("layouts/btrfs-xfs.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := layout.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "LABEL=ROOT / btrfs subvol=@,defaults,noatime,compress=zstd 0 0\n" +
+		"LABEL=ROOT /home btrfs subvol=@home,defaults,noatime,compress=zstd 0 0\n" +
+		"LABEL=VAR /var xfs defaults,noatime 0 0"
+	if fstab := layout.fstab(); fstab != expected {
+		t.Errorf("unexpected fstab:\n%s", fstab)
+	}
+
+	if cmdline := layout.kernelCmdline(); cmdline != "rootflags=subvol=@" {
+		t.Errorf("unexpected cmdline %s", cmdline)
+	}
+
+	// root and boot are found by the labels of the layout
+	layout.Partitions[2].FsLabel = "SYSTEM"
+	if root := layout.rootDevice(); root != "LABEL=SYSTEM" {
+		t.Errorf("unexpected root device %s", root)
+	}
+	if label := layout.labelOf("/boot"); label != "BOOT" {
+		t.Errorf("unexpected boot label %s", label)
+	}
+	layout.Partitions[2].FsLabel = "ROOT"
+
+	var packages []string
+	for _, tool := range layout.requiredGuestTools() {
+		packages = append(packages, tool.Package)
+	}
+	if got := strings.Join(packages, " "); got != "btrfs-progs xfsprogs" {
+		t.Errorf("unexpected packages %s", got)
+	}
+}
+
+func TestValidateMkfsOptions(t *testing.T) {
+	layout := NewDefaultLayout()
+	layout.Partitions[3].Fstype = FstypeXfs
+	layout.Partitions[3].MkfsOptions = &MkfsOptions{InodeRatio: 16384}
+	if err := layout.validate(); err == nil {
+		t.Errorf("expected error for inodeRatio on xfs")
+	}
+
+	reserved := 0
+	layout.Partitions[3].Fstype = FstypeExt4
+	layout.Partitions[3].MkfsOptions = &MkfsOptions{InodeRatio: 16384, ReservedBlocks: &reserved}
+	if err := layout.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	layout.Partitions[3].Fstype = "zfs"
+	if err := layout.validate(); err == nil {
+		t.Errorf("expected error for unsupported fstype")
+	}
+}
+
+func TestParseVerityLayout(t *testing.T) {
+	layout, err := parseDisklayout("layouts/verity.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := layout.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if root := layout.rootDevice(); root != "/dev/mapper/vroot" {
+		t.Errorf("unexpected root device %s", root)
+	}
+
+	cmdline := layout.kernelCmdline()
+	for _, arg := range []string{
+		"d2b.verity.hash=/dev/disk/by-partlabel/roothash",
+		"d2b.verity.roothash=" + verityRootHashPlaceholder,
+		"rootfstype=squashfs",
+		"d2b.overlay=/etc",
+		"d2b.overlay.storage=LABEL=VAR",
+	} {
+		if !strings.Contains(cmdline, arg) {
+			t.Errorf("missing %s in cmdline %s", arg, cmdline)
+		}
+	}
+
+	if !strings.HasPrefix(layout.fstab(), "/dev/mapper/vroot / squashfs ro 0 0\n") {
+		t.Errorf("unexpected fstab:\n%s", layout.fstab())
+	}
+
+	layout.Verity.HashPartition = "var"
+	if err := layout.validate(); err == nil {
+		t.Errorf("expected error for hash partition with a filesystem")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/binchenx/guestfs"
+)
+
+// root filesystems on a whole device, for the outputs booting without a
+// partitioned disk
+
+// launchScratchRoot create file of size bytes and launch the appliance with an
+// ext4 filesystem labeled label on it, mounted at /
+func launchScratchRoot(file string, size int64, label string, config *Config, debug bool) *guestfs.Guestfs {
+	f, err := os.Create(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		log.Fatal(err)
+	}
+	f.Close()
+
+	g, errno := guestfs.Create()
+	if errno != nil {
+		panic(errno)
+	}
+	if debug == true {
+		g.Set_trace(true)
+	}
+	optargs := guestfs.OptargsAdd_drive{
+		Format_is_set: true,
+		Format:        "raw",
+	}
+	if err := g.Add_drive(file, &optargs); err != nil {
+		panic(err)
+	}
+	if customizeNeedNetwork(config.Customize) {
+		if err := g.Set_network(true); err != nil {
+			panic(err)
+		}
+	}
+	if err := g.Launch(); err != nil {
+		panic(err)
+	}
+	devices, gerr := g.List_devices()
+	if gerr != nil {
+		panic(gerr)
+	}
+
+	if err := createFilesystem(g, devices[0], FstypeExt4, label, nil, nil); err != nil {
+		log.Fatalf("Fail to create fs on %s: %s\n", devices[0], err)
+	}
+	if err := g.Mount(devices[0], "/"); err != nil {
+		log.Fatalln(err.Errmsg)
+	}
+	return g
+}
+
+// populateScratchRoot copy the contents and apply the config, the initramfs
+// and generalize are left to the caller
+func populateScratchRoot(g *guestfs.Guestfs, contents *[]Content, config *Config, target *Target) {
+	layout := &DiskLayout{ParitionType: PartitionTypeGpt}
+	if err := copyRootfsData(g, contents, layout); err != nil {
+		log.Fatalf("Fail to import rootfs data %s\n", err)
+	}
+	customizeGuest(g, config, layout)
+	createAdditionalSettings(g, layout)
+	installTargetSettings(g, target)
+}
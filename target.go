@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/binchenx/guestfs"
+)
+
+// Target is the platform the disk boots on
+type Target struct {
+	Name string
+	// KernelCmdline replace defaultKernelCmdline, it sets the consoles
+	KernelCmdline string
+	// InitramfsModules are the drivers needed to find root
+	InitramfsModules []string
+	// Datasources is the default cloud-init datasource_list
+	Datasources []string
+	// NTPServers of systemd-timesyncd, the distro default if empty
+	NTPServers []string
+	// Packages are the guest agents installed with the image
+	Packages []string
+	// OutputFormat of the disk, see output.go
+	OutputFormat string
+}
+
+// TargetNone keep the disk as it is built, a raw disk for qemu
+const TargetNone = "none"
+
+var virtioModules = []string{"virtio_pci", "virtio_blk", "virtio_scsi", "virtio_net"}
+
+var targets = map[string]*Target{
+	TargetNone: {
+		Name:          TargetNone,
+		KernelCmdline: defaultKernelCmdline,
+		OutputFormat:  OutputFormatRaw,
+	},
+	"qemu": {
+		Name:             "qemu",
+		KernelCmdline:    defaultKernelCmdline,
+		InitramfsModules: virtioModules,
+		Datasources:      []string{"NoCloud", "None"},
+		Packages:         []string{"qemu-guest-agent"},
+		OutputFormat:     OutputFormatQcow2,
+	},
+	"openstack": {
+		Name:             "openstack",
+		KernelCmdline:    "console=tty1 console=ttyS0,115200 no_timer_check",
+		InitramfsModules: virtioModules,
+		Datasources:      []string{"ConfigDrive", "OpenStack", "None"},
+		Packages:         []string{"qemu-guest-agent"},
+		OutputFormat:     OutputFormatQcow2,
+	},
+	"aws": {
+		Name: "aws",
+		// nvme ebs volumes must not time out
+		KernelCmdline:    "console=tty1 console=ttyS0,115200 nvme_core.io_timeout=4294967295",
+		InitramfsModules: []string{"ena", "nvme", "xen-blkfront", "xen-netfront"},
+		Datasources:      []string{"Ec2", "None"},
+		// amazon time sync service
+		NTPServers:   []string{"169.254.169.123"},
+		OutputFormat: OutputFormatRaw,
+	},
+	"azure": {
+		Name:             "azure",
+		KernelCmdline:    "console=tty1 console=ttyS0,115200n8 earlyprintk=ttyS0,115200 rootdelay=300",
+		InitramfsModules: []string{"hv_vmbus", "hv_storvsc", "hv_netvsc", "hv_utils"},
+		Datasources:      []string{"Azure"},
+		Packages:         []string{"walinuxagent"},
+		OutputFormat:     OutputFormatVhd,
+	},
+	"gce": {
+		Name:             "gce",
+		KernelCmdline:    "console=ttyS0,38400n8d",
+		InitramfsModules: []string{"virtio_pci", "virtio_scsi", "virtio_net", "nvme", "gve"},
+		Datasources:      []string{"GCE", "None"},
+		NTPServers:       []string{"metadata.google.internal"},
+		Packages:         []string{"google-guest-agent", "google-compute-engine-oslogin"},
+		OutputFormat:     OutputFormatGce,
+	},
+}
+
+func targetNames() []string {
+	var names []string
+	for name := range targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// target return the profile of the config target, TargetNone if not set
+func (c *Config) target() (*Target, error) {
+	name := c.Target
+	if name == "" {
+		name = TargetNone
+	}
+	t, ok := targets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown target %s, should be one of %s", name, strings.Join(targetNames(), ", "))
+	}
+	return t, nil
+}
+
+// applyTarget add the packages and the cloud-init datasources of the target to
+// the config, the datasources of the config are kept. The packages are
+// installed when the image is built if fromImage is false, in the guest
+// otherwise.
+func (c *Config) applyTarget(t *Target, fromImage bool) {
+	if len(t.Packages) != 0 {
+		if fromImage {
+			c.Customize = append([]Customization{{Install: t.Packages}}, c.Customize...)
+		} else {
+			c.Packages = append(c.Packages, t.Packages...)
+		}
+	}
+
+	if len(t.Datasources) != 0 {
+		if c.CloudInit == nil {
+			c.CloudInit = &CloudInit{}
+		}
+		if len(c.CloudInit.Datasources) == 0 {
+			c.CloudInit.Datasources = t.Datasources
+		}
+	}
+}
+
+const (
+	initramfsModulesFile = "/etc/initramfs-tools/modules"
+	timesyncdConfFile    = "/etc/systemd/timesyncd.conf.d/d2b.conf"
+)
+
+// timesyncdConf return the systemd-timesyncd setting of the target
+func (t *Target) timesyncdConf() string {
+	return "[Time]\nNTP=" + strings.Join(t.NTPServers, " ") + "\n"
+}
+
+// install the settings of the target, call it before updateInitramfs
+func installTargetSettings(g *guestfs.Guestfs, t *Target) {
+	if len(t.InitramfsModules) == 0 && len(t.NTPServers) == 0 {
+		return
+	}
+	log.Printf("[Info] Setup target %s\n", t.Name)
+
+	if len(t.InitramfsModules) != 0 {
+		var modules string
+		if exists, _ := g.Exists(initramfsModulesFile); exists {
+			var err *guestfs.GuestfsError
+			if modules, err = g.Cat(initramfsModulesFile); err != nil {
+				log.Fatalln(err.Errmsg)
+			}
+		}
+		if modules != "" && !strings.HasSuffix(modules, "\n") {
+			modules += "\n"
+		}
+		modules += strings.Join(t.InitramfsModules, "\n") + "\n"
+		if err := g.Mkdir_p(path.Dir(initramfsModulesFile)); err != nil {
+			log.Fatalln(err.Errmsg)
+		}
+		if err := g.Write(initramfsModulesFile, []byte(modules)); err != nil {
+			log.Fatalln(err.Errmsg)
+		}
+	}
+
+	if len(t.NTPServers) != 0 {
+		if err := g.Mkdir_p(path.Dir(timesyncdConfFile)); err != nil {
+			log.Fatalln(err.Errmsg)
+		}
+		if err := g.Write(timesyncdConfFile, []byte(t.timesyncdConf())); err != nil {
+			log.Fatalln(err.Errmsg)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTarget(t *testing.T) {
+	c := &Config{}
+	target, err := c.target()
+	if err != nil || target.Name != TargetNone || target.KernelCmdline != defaultKernelCmdline {
+		t.Errorf("unexpected default target %#v %v", target, err)
+	}
+
+	c = &Config{Target: "vmware"}
+	if _, err := c.target(); err == nil {
+		t.Errorf("expected error for unknown target")
+	}
+
+	for _, name := range targetNames() {
+		if err := validateOutputFormat(targets[name].OutputFormat); err != nil {
+			t.Errorf("target %s: %s", name, err)
+		}
+	}
+}
+
+func TestApplyTarget(t *testing.T) {
+	gce := targets["gce"]
+
+	c := &Config{Packages: []string{"curl"}}
+	c.applyTarget(gce, false)
+	if len(c.Packages) != 3 || c.Packages[1] != "google-guest-agent" {
+		t.Errorf("unexpected packages %v", c.Packages)
+	}
+	if c.CloudInit == nil || c.CloudInit.Datasources[0] != "GCE" {
+		t.Errorf("unexpected cloud-init %#v", c.CloudInit)
+	}
+
+	// installed in the guest for a docker image, the datasources of the
+	// config are kept
+	c = &Config{CloudInit: &CloudInit{Datasources: []string{"NoCloud"}}}
+	c.applyTarget(gce, true)
+	if len(c.Packages) != 0 || len(c.Customize) != 1 || c.Customize[0].Install[0] != "google-guest-agent" {
+		t.Errorf("unexpected customize %#v", c.Customize)
+	}
+	if c.CloudInit.Datasources[0] != "NoCloud" {
+		t.Errorf("unexpected datasources %v", c.CloudInit.Datasources)
+	}
+
+	if conf := gce.timesyncdConf(); conf != "[Time]\nNTP=metadata.google.internal\n" {
+		t.Errorf("unexpected timesyncd.conf %s", conf)
+	}
+}
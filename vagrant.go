@@ -0,0 +1,146 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+// vagrant boxes, a gzipped tar of the disk, metadata.json and a Vagrantfile
+// setting the hardware, see https://www.vagrantup.com/docs/boxes/format
+
+const (
+	OutputFormatVagrantLibvirt    = "vagrant-libvirt"
+	OutputFormatVagrantVirtualbox = "vagrant-virtualbox"
+)
+
+var vagrantfileTemplate = template.Must(template.New("Vagrantfile").Parse(`Vagrant.configure("2") do |config|
+{{- if eq .Provider "libvirt" }}
+  config.vm.provider :libvirt do |libvirt|
+    libvirt.driver = "kvm"
+    libvirt.cpus = {{ .VM.CPUs }}
+    libvirt.memory = {{ .VM.Memory }}
+{{- if eq .VM.Firmware "efi" }}
+    libvirt.loader = "/usr/share/OVMF/OVMF_CODE.fd"
+{{- end }}
+  end
+{{- else }}
+  config.vm.provider :virtualbox do |vb|
+    vb.cpus = {{ .VM.CPUs }}
+    vb.memory = {{ .VM.Memory }}
+{{- if eq .VM.Firmware "efi" }}
+    vb.customize ["modifyvm", :id, "--firmware", "efi"]
+{{- end }}
+  end
+{{- end }}
+end
+`))
+
+func vagrantfile(provider string, vm *virtualMachine) (string, error) {
+	var buf bytes.Buffer
+	err := vagrantfileTemplate.Execute(&buf, map[string]interface{}{
+		"Provider": provider,
+		"VM":       vm,
+	})
+	return buf.String(), err
+}
+
+// vagrantMetadata return the metadata.json of the box
+func vagrantMetadata(provider string, vm *virtualMachine) ([]byte, error) {
+	const GB = 1024 * 1024 * 1024
+	metadata := map[string]interface{}{"provider": provider}
+	if provider == "libvirt" {
+		metadata["format"] = "qcow2"
+		metadata["virtual_size"] = (vm.DiskSize + GB - 1) / GB
+	}
+	return json.MarshalIndent(metadata, "", "  ")
+}
+
+func packVagrantLibvirt(raw string, out string, vm *virtualMachine) error {
+	return packVagrantBox(raw, out, vm, "libvirt", func(dir string) ([]string, error) {
+		if err := qemuImgConvert(raw, filepath.Join(dir, "box.img"), OutputFormatQcow2); err != nil {
+			return nil, err
+		}
+		return []string{"box.img"}, nil
+	})
+}
+
+func packVagrantVirtualbox(raw string, out string, vm *virtualMachine) error {
+	return packVagrantBox(raw, out, vm, "virtualbox", func(dir string) ([]string, error) {
+		vmdk := "box-disk1.vmdk"
+		if err := qemuImgConvert(raw, filepath.Join(dir, vmdk), OutputFormatVmdk); err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(filepath.Join(dir, vmdk))
+		if err != nil {
+			return nil, err
+		}
+		ovf, err := ovfDescriptor(vm, vmdk, info.Size())
+		if err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "box.ovf"), []byte(ovf), 0644); err != nil {
+			return nil, err
+		}
+		return []string{"box.ovf", vmdk}, nil
+	})
+}
+
+// packVagrantBox write the box of provider with the disk files created in dir
+// by addDisk
+func packVagrantBox(raw string, out string, vm *virtualMachine, provider string, addDisk func(dir string) ([]string, error)) error {
+	dir, err := ioutil.TempDir(filepath.Dir(out), "d2b-box")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	files, err := addDisk(dir)
+	if err != nil {
+		return err
+	}
+
+	metadata, err := vagrantMetadata(provider, vm)
+	if err != nil {
+		return err
+	}
+	v, err := vagrantfile(provider, vm)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "metadata.json"), append(metadata, '\n'), 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "Vagrantfile"), []byte(v), 0644); err != nil {
+		return err
+	}
+	files = append([]string{"metadata.json", "Vagrantfile"}, files...)
+
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	for _, name := range files {
+		if err := addFileToTar(tw, filepath.Join(dir, name), name); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(raw)
+}
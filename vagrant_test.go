@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVagrantBoxFiles(t *testing.T) {
+	const GB = 1024 * 1024 * 1024
+	vm := &virtualMachine{Name: "myos", CPUs: 2, Memory: 2048, NICs: 1, Firmware: FirmwareEfi, DiskSize: 2 * GB}
+
+	v, err := vagrantfile("libvirt", vm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(v, "libvirt.memory = 2048\n") || !strings.Contains(v, "libvirt.loader") {
+		t.Errorf("unexpected Vagrantfile\n%s", v)
+	}
+
+	vm.Firmware = FirmwareBios
+	v, err = vagrantfile("virtualbox", vm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(v, "vb.cpus = 2\n") || strings.Contains(v, "--firmware") {
+		t.Errorf("unexpected Vagrantfile\n%s", v)
+	}
+
+	metadata, err := vagrantMetadata("libvirt", vm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(metadata), `"virtual_size": 2`) || !strings.Contains(string(metadata), `"format": "qcow2"`) {
+		t.Errorf("unexpected metadata.json %s", metadata)
+	}
+}
+
+func TestLibvirtDomain(t *testing.T) {
+	vm := &virtualMachine{Name: "myos", CPUs: 4, Memory: 2048, NICs: 2, Firmware: FirmwareEfi}
+	domain, err := libvirtDomain(vm, "/images/myos.qcow2", OutputFormatQcow2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"<os firmware='efi'>",
+		"<vcpu>4</vcpu>",
+		"<driver name='qemu' type='qcow2'/>",
+		"<source file='/images/myos.qcow2'/>",
+		"<target type='serial' port='0'/>",
+	} {
+		if !strings.Contains(domain, s) {
+			t.Errorf("missing %s in\n%s", s, domain)
+		}
+	}
+	if strings.Count(domain, "<model type='virtio'/>") != 2 {
+		t.Errorf("expected 2 nics in\n%s", domain)
+	}
+	if file := libvirtDomainFile("/images/myos.qcow2"); file != "/images/myos.xml" {
+		t.Errorf("unexpected domain file %s", file)
+	}
+
+	if _, err := libvirtDomain(vm, "myos.ova", OutputFormatOva); err == nil {
+		t.Errorf("expected error for ova")
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/binchenx/guestfs"
+)
+
+// read-only root protected by dm-verity
+//
+// The root partition is populated as usual, then sealed once everything else
+// is done: it is optionally converted to squashfs, the hash tree is written to
+// the hash partition and the root hash is patched into the kernel cmdline of
+// grub.cfg. An initramfs script opens the verity device before root is mounted
+// and another one mounts the writable overlays on top of the read-only root.
+type Verity struct {
+	// HashPartition is the name of the partition holding the hash tree
+	HashPartition string `yaml:"hashPartition"`
+	// Format of the root filesystem, VerityFormatExt4 (default) or
+	// VerityFormatSquashfs. Root is always built as ext4 and converted after.
+	Format string `yaml:"format,omitempty"`
+	// Overlays are the directories of root made writable with an overlay, e.g. /etc
+	Overlays []string `yaml:"overlays,omitempty"`
+	// OverlayStorage is the mount point of the writable filesystem storing the
+	// overlay changes, e.g. /var. If empty the changes are kept in memory and
+	// lost at reboot.
+	OverlayStorage string `yaml:"overlayStorage,omitempty"`
+}
+
+const (
+	VerityFormatExt4     = "ext4"
+	VerityFormatSquashfs = "squashfs"
+)
+
+const (
+	// device mapper name of the verity root
+	verityMapperName = "vroot"
+	// replaced in grub.cfg by the root hash once root is sealed
+	verityRootHashPlaceholder = "D2B_VERITY_ROOTHASH"
+	// where the overlay changes are stored in OverlayStorage
+	verityOverlayDir = "/.d2b-overlay"
+)
+
+func (v *Verity) format() string {
+	if v.Format == "" {
+		return VerityFormatExt4
+	}
+	return v.Format
+}
+
+func (d *DiskLayout) validateVerity() error {
+	v := d.Verity
+	if v == nil {
+		return nil
+	}
+
+	if v.format() != VerityFormatExt4 && v.format() != VerityFormatSquashfs {
+		return fmt.Errorf("verity: unsupported format %s", v.Format)
+	}
+
+	var root, hash *Partition
+	for i := range d.Partitions {
+		p := &d.Partitions[i]
+		if p.MountPoint == "/" {
+			root = p
+		}
+		if p.Name == v.HashPartition {
+			hash = p
+		}
+	}
+
+	if root == nil || root.Name != PartitionNameRoot {
+		return fmt.Errorf("verity: root must be on the %s partition", PartitionNameRoot)
+	}
+	if root.Fstype != FstypeExt4 || root.Encrypted != "" {
+		return fmt.Errorf("verity: root must be a not encrypted ext4 partition")
+	}
+	if hash == nil {
+		return fmt.Errorf("verity: hash partition %s not found", v.HashPartition)
+	}
+	if hash.Fstype != "" || hash.MountPoint != "" || hash.Encrypted != "" {
+		return fmt.Errorf("verity: hash partition %s should have no filesystem", v.HashPartition)
+	}
+
+	for _, o := range v.Overlays {
+		if !filepath.IsAbs(o) || o == "/" {
+			return fmt.Errorf("verity: overlay %s should be an absolute path other than /", o)
+		}
+	}
+
+	if v.OverlayStorage != "" {
+		var found bool
+		for _, m := range d.mountables() {
+			if m.MountPoint == v.OverlayStorage && m.MountPoint != "/" && m.FsLabel != "" {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("verity: overlay storage %s is not a labeled writable filesystem", v.OverlayStorage)
+		}
+	}
+
+	return nil
+}
+
+// verityCmdline return the kernel cmdline used by the initramfs scripts
+func (d *DiskLayout) verityCmdline() []string {
+	v := d.Verity
+	cmdline := []string{
+		"d2b.verity.data=/dev/disk/by-partlabel/" + PartitionNameRoot,
+		"d2b.verity.hash=/dev/disk/by-partlabel/" + v.HashPartition,
+		"d2b.verity.roothash=" + verityRootHashPlaceholder,
+		"rootfstype=" + v.format(),
+	}
+
+	if len(v.Overlays) != 0 {
+		cmdline = append(cmdline, "d2b.overlay="+strings.Join(v.Overlays, ","))
+		for _, m := range d.mountables() {
+			if v.OverlayStorage != "" && m.MountPoint == v.OverlayStorage {
+				cmdline = append(cmdline, "d2b.overlay.storage=LABEL="+m.FsLabel)
+			}
+		}
+	}
+
+	return cmdline
+}
+
+// initramfs-tools hook and scripts, see initramfs-tools(7)
+const verityInitramfsHook = `#!/bin/sh
+PREREQ=""
+prereqs() { echo "$PREREQ"; }
+case $1 in prereqs) prereqs; exit 0;; esac
+
+. /usr/share/initramfs-tools/hook-functions
+copy_exec /sbin/veritysetup /sbin
+manual_add_modules dm_verity overlay squashfs
+`
+
+const verityInitramfsLocalTop = `#!/bin/sh
+PREREQ="udev"
+prereqs() { echo "$PREREQ"; }
+case $1 in prereqs) prereqs; exit 0;; esac
+
+. /scripts/functions
+
+for x in $(cat /proc/cmdline); do
+	case $x in
+	d2b.verity.data=*) DATA=${x#*=} ;;
+	d2b.verity.hash=*) HASH=${x#*=} ;;
+	d2b.verity.roothash=*) ROOTHASH=${x#*=} ;;
+	esac
+done
+
+[ -n "$ROOTHASH" ] || exit 0
+
+wait_for_udev 10
+veritysetup open "$DATA" ` + verityMapperName + ` "$HASH" "$ROOTHASH" || panic "dm-verity: fail to open root"
+`
+
+const verityInitramfsLocalBottom = `#!/bin/sh
+PREREQ=""
+prereqs() { echo "$PREREQ"; }
+case $1 in prereqs) prereqs; exit 0;; esac
+
+. /scripts/functions
+
+for x in $(cat /proc/cmdline); do
+	case $x in
+	d2b.overlay=*) OVERLAYS=${x#*=} ;;
+	d2b.overlay.storage=*) STORAGE=${x#*=} ;;
+	esac
+done
+
+[ -n "$OVERLAYS" ] || exit 0
+
+# /run is moved to the real root by init, so are the mounts below it
+mkdir -p /run/d2b-overlay
+if [ -n "$STORAGE" ]; then
+	mount "$(resolve_device "$STORAGE")" /run/d2b-overlay || panic "overlay: fail to mount $STORAGE"
+else
+	mount -t tmpfs tmpfs /run/d2b-overlay
+fi
+
+for dir in $(echo "$OVERLAYS" | tr ',' ' '); do
+	base=/run/d2b-overlay` + verityOverlayDir + `$dir
+	mkdir -p "$base/upper" "$base/work"
+	mount -t overlay overlay -o "lowerdir=${rootmnt}$dir,upperdir=$base/upper,workdir=$base/work" "${rootmnt}$dir" ||
+		panic "overlay: fail to mount $dir"
+done
+`
+
+// install the initramfs hook and scripts, call it before updateInitramfs
+func installVerityInitramfs(g *guestfs.Guestfs, diskLayout *DiskLayout) {
+	if diskLayout.Verity == nil {
+		return
+	}
+
+	files := map[string]string{
+		"/etc/initramfs-tools/hooks/d2b-verity":                 verityInitramfsHook,
+		"/etc/initramfs-tools/scripts/local-top/d2b-verity":     verityInitramfsLocalTop,
+		"/etc/initramfs-tools/scripts/local-bottom/d2b-overlay": verityInitramfsLocalBottom,
+	}
+	for file, content := range files {
+		if err := g.Mkdir_p(filepath.Dir(file)); err != nil {
+			log.Fatalln(err.Errmsg)
+		}
+		if err := g.Write(file, []byte(content)); err != nil {
+			log.Fatalln(err.Errmsg)
+		}
+		if err := g.Chmod(0755, file); err != nil {
+			log.Fatalln(err.Errmsg)
+		}
+	}
+	log.Println("[Info] Install dm-verity initramfs scripts")
+}
+
+var verityRootHashRe = regexp.MustCompile(`Root hash:\s*([0-9a-f]+)`)
+
+// seal the root partition, this must be the last step writing to root
+func sealVerityRoot(g *guestfs.Guestfs, diskLayout *DiskLayout) {
+	v := diskLayout.Verity
+	if v == nil {
+		return
+	}
+
+	log.Println("[Info] Seal root with dm-verity")
+	rootDevice, err := getPartitionDeviceByName(g, PartitionNameRoot)
+	if err != nil {
+		log.Fatal(err)
+	}
+	hashDevice, err := getPartitionDeviceByName(g, v.HashPartition)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if v.format() == VerityFormatSquashfs {
+		convertRootToSquashfs(g, rootDevice)
+	}
+
+	// veritysetup is run from the image, which needs root mounted
+	if err := g.Umount_all(); err != nil {
+		log.Fatalln(err.Errmsg)
+	}
+	if err := g.Mount_ro(rootDevice, "/"); err != nil {
+		log.Fatalln(err.Errmsg)
+	}
+	out, gerr := g.Command([]string{"veritysetup", "format", rootDevice, hashDevice})
+	if gerr != nil {
+		log.Fatalf("Fail to create verity hash tree %s %s\n", out, gerr.Errmsg)
+	}
+	match := verityRootHashRe.FindStringSubmatch(out)
+	if match == nil {
+		log.Fatalf("Fail to find root hash in veritysetup output %s\n", out)
+	}
+	rootHash := match[1]
+	log.Printf("[Info]   Root hash %s\n", rootHash)
+
+	if err := g.Umount_all(); err != nil {
+		log.Fatalln(err.Errmsg)
+	}
+
+	// grub.cfg is on the efi partition
+	efiDevice, err := getPartitionDeviceByName(g, PartitionNameEFI)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var efiMountPoint string
+	for _, m := range diskLayout.mountables() {
+		if m.Partition == PartitionNameEFI {
+			efiMountPoint = m.MountPoint
+		}
+	}
+	cfg, rerr := filepath.Rel(efiMountPoint, grubCfg)
+	if rerr != nil || strings.HasPrefix(cfg, "..") {
+		log.Fatalf("%s is not on the efi partition\n", grubCfg)
+	}
+	cfg = "/" + cfg
+
+	if err := g.Mount(efiDevice, "/"); err != nil {
+		log.Fatalln(err.Errmsg)
+	}
+	content, gerr := g.Cat(cfg)
+	if gerr != nil {
+		log.Fatalln(gerr.Errmsg)
+	}
+	content = strings.ReplaceAll(content, verityRootHashPlaceholder, rootHash)
+	if err := g.Write(cfg, []byte(content)); err != nil {
+		log.Fatalln(err.Errmsg)
+	}
+	if err := g.Umount_all(); err != nil {
+		log.Fatalln(err.Errmsg)
+	}
+}
+
+// replace the ext4 root with a squashfs of its content
+func convertRootToSquashfs(g *guestfs.Guestfs, rootDevice string) {
+	if err := g.Umount_all(); err != nil {
+		log.Fatalln(err.Errmsg)
+	}
+	if err := g.Mount_ro(rootDevice, "/"); err != nil {
+		log.Fatalln(err.Errmsg)
+	}
+
+	squashfs, err := ioutil.TempFile(os.TempDir(), "d2b-root*.squashfs")
+	if err != nil {
+		log.Fatal(err)
+	}
+	squashfs.Close()
+	defer os.Remove(squashfs.Name())
+
+	// the mount points of the other filesystems are kept empty
+	if err := g.Mksquashfs("/", squashfs.Name(), nil); err != nil {
+		log.Fatalf("Fail to create squashfs %s\n", err.Errmsg)
+	}
+	if err := g.Umount_all(); err != nil {
+		log.Fatalln(err.Errmsg)
+	}
+	if err := g.Upload(squashfs.Name(), rootDevice); err != nil {
+		log.Fatalf("Fail to write squashfs to %s: %s\n", rootDevice, err.Errmsg)
+	}
+	log.Printf("[Info]   Convert root %s to squashfs\n", rootDevice)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// virtual machines running the disk, described by the ova output
+
+const (
+	FirmwareBios = "bios"
+	FirmwareEfi  = "efi"
+)
+
+// firmware return the firmware booting the layout, bios is preferred when the
+// layout has a bios boot partition, found by its gpt type or its name, since
+// every hypervisor supports it
+func (d *DiskLayout) firmware() string {
+	for _, p := range d.Partitions {
+		if strings.EqualFold(p.GptType, GptTypeBiosBoot) || p.Name == PartitionNameBiosboot {
+			return FirmwareBios
+		}
+	}
+	return FirmwareEfi
+}
+
+type virtualMachine struct {
+	Name     string
+	CPUs     int
+	Memory   int
+	NICs     int
+	Firmware string
+	// DiskSize in bytes
+	DiskSize int64
+	// Layout of the disk, the outputs not booting the disk read root with it
+	Layout *DiskLayout
+	// KernelCmdline is the cmdline of the target
+	KernelCmdline string
+}
+
+// newVirtualMachine return the machine named after out, running disk
+func newVirtualMachine(out string, vm *VM, layout *DiskLayout, disk Disk, cmdline string) *virtualMachine {
+	m := &virtualMachine{
+		Name:          strings.TrimSuffix(filepath.Base(out), filepath.Ext(out)),
+		CPUs:          2,
+		Memory:        2048,
+		NICs:          1,
+		Firmware:      layout.firmware(),
+		DiskSize:      disk.Size,
+		Layout:        layout,
+		KernelCmdline: cmdline,
+	}
+	if vm != nil {
+		if vm.CPUs != 0 {
+			m.CPUs = vm.CPUs
+		}
+		if vm.Memory != 0 {
+			m.Memory = vm.Memory
+		}
+		if vm.NICs != 0 {
+			m.NICs = vm.NICs
+		}
+	}
+	return m
+}
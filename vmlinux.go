@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+)
+
+// extract the uncompressed elf kernel from a bzImage, like
+// scripts/extract-vmlinux of the kernel. The payload is found with the boot
+// protocol header, see Documentation/x86/boot.rst.
+
+const (
+	bzImageSetupSects    = 0x1f1
+	bzImageHeaderMagic   = 0x202
+	bzImagePayloadOffset = 0x248
+	bzImagePayloadLength = 0x24c
+)
+
+var (
+	gzipMagic      = []byte{0x1f, 0x8b}
+	lz4LegacyMagic = []byte{0x02, 0x21, 0x4c, 0x18}
+	elfMagic       = []byte{0x7f, 'E', 'L', 'F'}
+)
+
+// the compressions the kernel may use, only gzip and lz4 are supported
+var kernelCompressions = []struct {
+	Name  string
+	Magic []byte
+}{
+	{"gzip", gzipMagic},
+	{"lz4", lz4LegacyMagic},
+	{"xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{"bzip2", []byte{'B', 'Z', 'h'}},
+	{"lzo", []byte{0x89, 'L', 'Z', 'O'}},
+	{"lzma", []byte{0x5d, 0x00, 0x00}},
+}
+
+// bzImagePayload return the compressed kernel of the bzImage
+func bzImagePayload(image []byte) ([]byte, error) {
+	if len(image) < bzImagePayloadLength+4 || string(image[bzImageHeaderMagic:bzImageHeaderMagic+4]) != "HdrS" {
+		return nil, fmt.Errorf("not a bzImage")
+	}
+	setupSects := int(image[bzImageSetupSects])
+	if setupSects == 0 {
+		setupSects = 4
+	}
+	// the offset is relative to the protected mode code after the setup
+	offset := (setupSects+1)*512 + int(binary.LittleEndian.Uint32(image[bzImagePayloadOffset:]))
+	length := int(binary.LittleEndian.Uint32(image[bzImagePayloadLength:]))
+	if length == 0 || offset+length > len(image) {
+		return nil, fmt.Errorf("invalid bzImage payload %d+%d", offset, length)
+	}
+	return image[offset : offset+length], nil
+}
+
+// extractVmlinux return the elf kernel of the bzImage
+func extractVmlinux(image []byte) ([]byte, error) {
+	if bytes.HasPrefix(image, elfMagic) {
+		return image, nil
+	}
+	payload, err := bzImagePayload(image)
+	if err != nil {
+		return nil, err
+	}
+
+	var vmlinux []byte
+	switch {
+	case bytes.HasPrefix(payload, gzipMagic):
+		r, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		// the payload is followed by its size, gzip stops at the end of the stream
+		r.Multistream(false)
+		if vmlinux, err = ioutil.ReadAll(r); err != nil {
+			return nil, err
+		}
+	case bytes.HasPrefix(payload, lz4LegacyMagic):
+		if vmlinux, err = lz4LegacyDecompress(payload); err != nil {
+			return nil, err
+		}
+	default:
+		for _, c := range kernelCompressions {
+			if bytes.HasPrefix(payload, c.Magic) {
+				return nil, fmt.Errorf("kernel compressed with %s is not supported", c.Name)
+			}
+		}
+		return nil, fmt.Errorf("unknown kernel compression")
+	}
+
+	if !bytes.HasPrefix(vmlinux, elfMagic) {
+		return nil, fmt.Errorf("decompressed kernel is not an elf")
+	}
+	return vmlinux, nil
+}
+
+// lz4LegacyDecompress decompress the lz4 legacy frame the kernel uses, made of
+// blocks of 8MB at most preceded by their compressed size
+func lz4LegacyDecompress(src []byte) ([]byte, error) {
+	const maxBlockSize = 8 << 20
+	var dst []byte
+	i := 0
+	for i+4 <= len(src) {
+		if bytes.Equal(src[i:i+4], lz4LegacyMagic) {
+			i += 4
+			continue
+		}
+		size := int(binary.LittleEndian.Uint32(src[i:]))
+		// the uncompressed size the kernel appends is not a block
+		if size == 0 || size > len(src)-i-4 || size > maxBlockSize {
+			break
+		}
+		i += 4
+		var err error
+		if dst, err = lz4DecompressBlock(src[i:i+size], dst); err != nil {
+			return nil, err
+		}
+		i += size
+	}
+	if len(dst) == 0 {
+		return nil, fmt.Errorf("lz4: no block")
+	}
+	return dst, nil
+}
+
+// lz4DecompressBlock append the decompressed block to dst, see
+// https://github.com/lz4/lz4/blob/dev/doc/lz4_Block_format.md
+func lz4DecompressBlock(src []byte, dst []byte) ([]byte, error) {
+	errCorrupted := fmt.Errorf("lz4: corrupted block")
+	i := 0
+	readLength := func(n int) (int, error) {
+		if n != 15 {
+			return n, nil
+		}
+		for {
+			if i >= len(src) {
+				return 0, errCorrupted
+			}
+			b := src[i]
+			i++
+			n += int(b)
+			if b != 255 {
+				return n, nil
+			}
+		}
+	}
+
+	for i < len(src) {
+		token := src[i]
+		i++
+
+		literals, err := readLength(int(token >> 4))
+		if err != nil {
+			return nil, err
+		}
+		if i+literals > len(src) {
+			return nil, errCorrupted
+		}
+		dst = append(dst, src[i:i+literals]...)
+		i += literals
+		// the last sequence has only literals
+		if i == len(src) {
+			break
+		}
+
+		if i+2 > len(src) {
+			return nil, errCorrupted
+		}
+		offset := int(src[i]) | int(src[i+1])<<8
+		i += 2
+		if offset == 0 || offset > len(dst) {
+			return nil, errCorrupted
+		}
+		match, err := readLength(int(token & 15))
+		if err != nil {
+			return nil, err
+		}
+		match += 4
+		// the match may overlap what it copies
+		start := len(dst) - offset
+		for j := 0; j < match; j++ {
+			dst = append(dst, dst[start+j])
+		}
+	}
+	return dst, nil
+}